@@ -2,9 +2,17 @@ package engine
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/volumes"
 	"github.com/containers/podman/v4/pkg/specgen"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -13,13 +21,178 @@ import (
 	"k8s.io/klog/v2"
 )
 
-const ansibleMethod = "ansible"
+const (
+	ansibleMethod       = "ansible"
+	ansibleImage        = "quay.io/fetchit/fetchit-ansible:latest"
+	ansibleVaultPass    = "/run/secrets/ansible-vault-password"
+	ansibleGalaxyDir    = "/galaxy"
+	ansibleGalaxyPrefix = "fetchit-ansible-galaxy-"
+)
 
 // Ansible to place and run ansible playbooks
 type Ansible struct {
 	CommonMethod `mapstructure:",squash"`
 	// SshDirectory for ansible to connect to host
 	SshDirectory string `mapstructure:"sshDirectory"`
+	// Inventory is either a path relative to targetPath to an inventory file or directory,
+	// or an inline list of hosts. Defaults to the ansible container's inventory
+	Inventory interface{} `mapstructure:"inventory"`
+	// ExtraVars is either a map of variables or a path relative to targetPath to a vars file
+	ExtraVars interface{} `mapstructure:"extraVars"`
+	// Only run plays and tasks tagged with these values
+	Tags []string `mapstructure:"tags"`
+	// Only run plays and tasks not tagged with these values
+	SkipTags []string `mapstructure:"skipTags"`
+	// Limit the run to a subset of the inventory, ansible's host pattern
+	Limit string `mapstructure:"limit"`
+	// If true, runs the playbook with --check and makes no changes
+	CheckMode bool `mapstructure:"checkMode"`
+	// If true, shows the differences in changed files and templates
+	Diff bool `mapstructure:"diff"`
+	// If true, runs operations with become
+	Become bool `mapstructure:"become"`
+	// Number of parallel processes, ansible's default when unset
+	Forks *int `mapstructure:"forks"`
+	// VaultPasswordFile is a file on the host holding the vault password, mounted read-only
+	VaultPasswordFile string `mapstructure:"vaultPasswordFile"`
+	// Requirements is a path relative to targetPath to a requirements.yml installed with
+	// ansible-galaxy before playbooks run. It is installed again only when the file changes
+	Requirements string `mapstructure:"requirements"`
+	// Playbook is one or more entry playbooks, relative to targetPath. When set, only these
+	// playbooks run, whenever a file under WatchPaths changes, and other yaml files are
+	// treated as roles, vars and templates that are never run on their own
+	Playbook []string `mapstructure:"playbook"`
+	// WatchPaths are directories or files, relative to targetPath, whose changes re-run
+	// the entry playbooks. Defaults to the whole targetPath
+	WatchPaths []string `mapstructure:"watchPaths"`
+	// recaps holds the results of the playbooks run by the most recent Apply
+	recaps []*AnsibleRecap
+}
+
+// AnsibleRecap is the result of one ansible-playbook run
+type AnsibleRecap struct {
+	Playbook string                       `json:"playbook"`
+	ExitCode int32                        `json:"exitCode"`
+	Hosts    map[string]*AnsibleHostStats `json:"hosts"`
+}
+
+// AnsibleHostStats are the per host counts from the play recap
+type AnsibleHostStats struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failures    int `json:"failures"`
+	Unreachable int `json:"unreachable"`
+	Skipped     int `json:"skipped"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+// Failed is true if the playbook exited non-zero or any host failed or was unreachable
+func (r *AnsibleRecap) Failed() bool {
+	if r.ExitCode != 0 {
+		return true
+	}
+	for _, h := range r.Hosts {
+		if h.Failures > 0 || h.Unreachable > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AnsibleRecap) String() string {
+	hosts := make([]string, 0, len(r.Hosts))
+	for name := range r.Hosts {
+		hosts = append(hosts, name)
+	}
+	sort.Strings(hosts)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s exit code %d", r.Playbook, r.ExitCode)
+	for _, name := range hosts {
+		h := r.Hosts[name]
+		fmt.Fprintf(&b, "; %s ok=%d changed=%d failed=%d unreachable=%d", name, h.Ok, h.Changed, h.Failures, h.Unreachable)
+	}
+	return b.String()
+}
+
+// ansibleOutput is what the json stdout callback prints
+type ansibleOutput struct {
+	Plays []struct {
+		Tasks []struct {
+			Task struct {
+				Name string `json:"name"`
+			} `json:"task"`
+			Hosts map[string]struct {
+				Failed      bool   `json:"failed"`
+				Unreachable bool   `json:"unreachable"`
+				Msg         string `json:"msg"`
+			} `json:"hosts"`
+		} `json:"tasks"`
+	} `json:"plays"`
+	Stats map[string]*AnsibleHostStats `json:"stats"`
+}
+
+// decodeAnsibleOutput reads the json stdout callback from the container's output, which
+// may be preceded by warnings
+func decodeAnsibleOutput(output string) (*ansibleOutput, error) {
+	start := strings.Index(output, "\n{")
+	if strings.HasPrefix(output, "{") {
+		start = 0
+	} else if start < 0 {
+		return nil, fmt.Errorf("no json callback output found")
+	}
+	result := &ansibleOutput{}
+	if err := json.NewDecoder(strings.NewReader(output[start:])).Decode(result); err != nil {
+		return nil, utils.WrapErr(err, "Error decoding ansible json output")
+	}
+	return result, nil
+}
+
+// parseAnsibleRecap reads the stats of the json stdout callback from the container's output
+func parseAnsibleRecap(output string) (map[string]*AnsibleHostStats, error) {
+	result, err := decodeAnsibleOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	return result.Stats, nil
+}
+
+// maxAnsibleMessage is how much of a failed task's message, or of output that is not json, is logged
+const maxAnsibleMessage = 1024
+
+// ansibleFailures describes the tasks that failed or found a host unreachable, with their message
+// but none of the vars or results the full output holds. Output without json, such as a syntax
+// error, is returned truncated.
+func ansibleFailures(output string) []string {
+	result, err := decodeAnsibleOutput(output)
+	if err != nil {
+		return []string{truncate(strings.TrimSpace(output), maxAnsibleMessage)}
+	}
+	var failures []string
+	for _, play := range result.Plays {
+		for _, task := range play.Tasks {
+			hosts := make([]string, 0, len(task.Hosts))
+			for name := range task.Hosts {
+				hosts = append(hosts, name)
+			}
+			sort.Strings(hosts)
+			for _, name := range hosts {
+				h := task.Hosts[name]
+				if h.Failed || h.Unreachable {
+					failures = append(failures, fmt.Sprintf("%s: task %q: %s", name, task.Task.Name, truncate(h.Msg, maxAnsibleMessage)))
+				}
+			}
+		}
+	}
+	return failures
+}
+
+// truncate shortens s to at most n bytes, keeping its end, where errors are reported
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
 }
 
 func (ans *Ansible) GetKind() string {
@@ -47,7 +220,7 @@ func (ans *Ansible) Process(ctx, conn context.Context, PAT string, skew int) {
 		}
 	}
 
-	err := currentToLatest(ctx, conn, ans, target, &tag)
+	err := currentToLatest(ctx, conn, ans, target, PAT, &tag)
 	if err != nil {
 		klog.Errorf("Error moving current to latest: %v", err)
 		return
@@ -60,17 +233,82 @@ func (ans *Ansible) MethodEngine(ctx context.Context, conn context.Context, chan
 	return ans.ansiblePodman(ctx, conn, path)
 }
 
+func (ans *Ansible) statusDetails() interface{} {
+	return ans.recaps
+}
+
 func (ans *Ansible) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
+	ans.recaps = nil
+	if len(ans.Playbook) > 0 {
+		// any change under the watched paths counts, not only yaml files
+		tags = nil
+	}
 	changeMap, err := applyChanges(ctx, ans.GetTarget(), ans.GetTargetPath(), ans.Glob, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
+	if len(ans.Playbook) > 0 {
+		return ans.runEntryPlaybooks(ctx, conn, changeMap)
+	}
+	if len(changeMap) > 0 && ans.Requirements != "" {
+		if err := ans.installRequirements(conn); err != nil {
+			return err
+		}
+	}
 	if err := runChanges(ctx, conn, ans, changeMap); err != nil {
 		return err
 	}
 	return nil
 }
 
+// runEntryPlaybooks runs each entry playbook, in the order declared, if any change is under the watched paths
+func (ans *Ansible) runEntryPlaybooks(ctx, conn context.Context, changeMap map[*object.Change]string) error {
+	var changed []string
+	for change := range changeMap {
+		if change.To.Name != "" {
+			changed = append(changed, change.To.Name)
+		}
+		if change.From.Name != "" && change.From.Name != change.To.Name {
+			changed = append(changed, change.From.Name)
+		}
+	}
+	if !ans.watched(changed) {
+		return nil
+	}
+	if ans.Requirements != "" {
+		if err := ans.installRequirements(conn); err != nil {
+			return err
+		}
+	}
+	base := filepath.Join(getDirectory(ans.GetTarget()), ans.GetTargetPath())
+	for _, playbook := range ans.Playbook {
+		path, err := utils.SafeJoin(base, playbook)
+		if err != nil {
+			return utils.WrapErr(err, "Invalid playbook path")
+		}
+		if err := ans.ansiblePodman(ctx, conn, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watched reports whether any of the changed files, relative to targetPath, is under one of the watched paths
+func (ans *Ansible) watched(changed []string) bool {
+	for _, name := range changed {
+		if len(ans.WatchPaths) == 0 {
+			return true
+		}
+		for _, w := range ans.WatchPaths {
+			w = filepath.Clean(w)
+			if w == "." || name == w || strings.HasPrefix(name, w+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (ans *Ansible) ansiblePodman(ctx, conn context.Context, path string) error {
 	// TODO: add logic to remove
 	if path == deleteFile {
@@ -79,14 +317,13 @@ func (ans *Ansible) ansiblePodman(ctx, conn context.Context, path string) error
 	klog.Infof("Deploying Ansible playbook %s\n", path)
 
 	copyFile := ("/opt/" + path)
-	sshImage := "quay.io/fetchit/fetchit-ansible:latest"
 
 	klog.Infof("Identifying if fetchit-ansible image exists locally")
-	if err := detectOrFetchImage(conn, sshImage, true); err != nil {
+	if err := detectOrFetchImage(conn, ansibleImage, true); err != nil {
 		return err
 	}
 
-	s := specgen.NewSpecGenerator(sshImage, false)
+	s := specgen.NewSpecGenerator(ansibleImage, false)
 	s.Name = "ansible" + "-" + ans.Name
 	s.Privileged = true
 	s.PidNS = specgen.Namespace{
@@ -94,27 +331,213 @@ func (ans *Ansible) ansiblePodman(ctx, conn context.Context, path string) error
 		Value:  "",
 	}
 
-	// TODO: Remove rcook entries
-	s.Command = []string{"sh", "-c", "/usr/bin/ansible-playbook -e ansible_connection=ssh " + copyFile}
+	args, err := ans.playbookArgs(copyFile)
+	if err != nil {
+		return err
+	}
+	s.Command = append([]string{"/usr/bin/ansible-playbook"}, args...)
 	s.Mounts = []specs.Mount{{Source: ans.SshDirectory, Destination: "/root/.ssh", Type: "bind", Options: []string{"rw"}}}
 	s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"ro"}}}
 	s.NetNS = specgen.Namespace{
 		NSMode: "host",
 		Value:  "",
 	}
-	createResponse, err := containers.CreateWithSpec(conn, s, nil)
+	// the json callback makes the play recap machine readable
+	s.Env = map[string]string{
+		"ANSIBLE_STDOUT_CALLBACK": "json",
+	}
+	if ans.VaultPasswordFile != "" {
+		s.Mounts = append(s.Mounts, specs.Mount{Source: ans.VaultPasswordFile, Destination: ansibleVaultPass, Type: "bind", Options: []string{"ro"}})
+	}
+	if ans.Requirements != "" {
+		s.Volumes = append(s.Volumes, &specgen.NamedVolume{Name: ans.galaxyVolume(), Dest: ansibleGalaxyDir, Options: []string{"ro"}})
+		for k, v := range galaxyEnv() {
+			s.Env[k] = v
+		}
+	}
+	createResponse, err := createAndStartContainer(conn, s)
 	if err != nil {
 		return err
 	}
 	klog.Infof("Container created.")
-	if err := containers.Start(conn, createResponse.ID, nil); err != nil {
-		return err
-	}
 	// Wait for the container to exit
-	err = waitAndRemoveContainer(conn, createResponse.ID)
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
 	if err != nil {
 		return err
 	}
-	klog.Infof("Container started....Requeuing")
+	recap := &AnsibleRecap{
+		Playbook: path,
+		ExitCode: exitCode,
+	}
+	ans.recaps = append(ans.recaps, recap)
+	recap.Hosts, err = parseAnsibleRecap(output)
+	if err != nil {
+		klog.Warningf("Ansible target: %s, unable to read play recap of %s: %v", ans.Name, path, err)
+	}
+	klog.Infof("Ansible target: %s, %s", ans.Name, recap)
+	if recap.Failed() {
+		for _, failure := range ansibleFailures(output) {
+			klog.Errorf("Ansible target: %s, playbook %s: %s", ans.Name, path, logRedactor.redact(failure))
+		}
+		return fmt.Errorf("ansible playbook %s failed: %s", path, recap)
+	}
 	return nil
 }
+
+// targetFile returns where a path relative to targetPath is in the target's git repository
+// below root, which it may not leave
+func (ans *Ansible) targetFile(root, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return "", fmt.Errorf("path %s must be relative to targetPath %s", p, ans.GetTargetPath())
+	}
+	return utils.SafeJoin(filepath.Join(root, getDirectory(ans.GetTarget())), filepath.Join(ans.GetTargetPath(), p))
+}
+
+// repoPath returns the path in the ansible container of a path relative to targetPath
+func (ans *Ansible) repoPath(p string) (string, error) {
+	return ans.targetFile("/opt", p)
+}
+
+// playbookArgs builds the ansible-playbook arguments for playbook. Every value is its own
+// argument, so no value is ever interpreted by a shell.
+func (ans *Ansible) playbookArgs(playbook string) ([]string, error) {
+	args := []string{"-e", "ansible_connection=ssh"}
+
+	switch inv := ans.Inventory.(type) {
+	case nil:
+	case string:
+		p, err := ans.repoPath(inv)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Invalid inventory path")
+		}
+		args = append(args, "-i", p)
+	case []interface{}:
+		hosts := make([]string, 0, len(inv))
+		for _, h := range inv {
+			host := strings.TrimSpace(fmt.Sprint(h))
+			if host == "" || strings.Contains(host, ",") {
+				return nil, fmt.Errorf("invalid inventory host %q", host)
+			}
+			hosts = append(hosts, host)
+		}
+		// a trailing comma tells ansible this is a host list, not a file
+		args = append(args, "-i", strings.Join(hosts, ",")+",")
+	default:
+		return nil, fmt.Errorf("inventory must be a path or a list of hosts, got %T", ans.Inventory)
+	}
+
+	switch vars := ans.ExtraVars.(type) {
+	case nil:
+	case string:
+		p, err := ans.repoPath(vars)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Invalid extraVars path")
+		}
+		args = append(args, "-e", "@"+p)
+	case map[string]interface{}:
+		b, err := json.Marshal(vars)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error encoding extraVars")
+		}
+		args = append(args, "-e", string(b))
+	default:
+		return nil, fmt.Errorf("extraVars must be a path or a map, got %T", ans.ExtraVars)
+	}
+
+	if len(ans.Tags) > 0 {
+		args = append(args, "--tags", strings.Join(ans.Tags, ","))
+	}
+	if len(ans.SkipTags) > 0 {
+		args = append(args, "--skip-tags", strings.Join(ans.SkipTags, ","))
+	}
+	if ans.Limit != "" {
+		args = append(args, "--limit", ans.Limit)
+	}
+	if ans.CheckMode {
+		args = append(args, "--check")
+	}
+	if ans.Diff {
+		args = append(args, "--diff")
+	}
+	if ans.Become {
+		args = append(args, "--become")
+	}
+	if ans.VaultPasswordFile != "" {
+		args = append(args, "--vault-password-file", ansibleVaultPass)
+	}
+	if ans.Forks != nil {
+		if *ans.Forks < 1 {
+			return nil, fmt.Errorf("forks must be at least 1, got %d", *ans.Forks)
+		}
+		args = append(args, "--forks", strconv.Itoa(*ans.Forks))
+	}
+	// end option parsing so the playbook path is never read as an option
+	return append(args, "--", playbook), nil
+}
+
+// galaxyVolume is the named volume that caches roles and collections installed from Requirements
+func (ans *Ansible) galaxyVolume() string {
+	return ansibleGalaxyPrefix + ans.Name
+}
+
+// galaxyEnv points ansible at the roles and collections in the galaxy volume
+func galaxyEnv() map[string]string {
+	return map[string]string{
+		"ANSIBLE_ROLES_PATH":       filepath.Join(ansibleGalaxyDir, "roles"),
+		"ANSIBLE_COLLECTIONS_PATH": filepath.Join(ansibleGalaxyDir, "collections"),
+	}
+}
+
+// installRequirements runs ansible-galaxy install into the galaxy volume when the
+// requirements file changed since the last install, or the volume does not exist
+func (ans *Ansible) installRequirements(conn context.Context) error {
+	requirements, err := ans.targetFile("", ans.Requirements)
+	if err != nil {
+		return utils.WrapErr(err, "Invalid requirements path")
+	}
+	sum, err := fileSHA256(requirements)
+	if err != nil {
+		return utils.WrapErr(err, "Error reading requirements file %s", requirements)
+	}
+	sumFile := filepath.Join("/opt", ".cache", ansibleMethod, ans.Name, "requirements.sha256")
+	exists, err := volumes.Exists(conn, ans.galaxyVolume(), nil)
+	if err != nil {
+		return err
+	}
+	if prev, err := os.ReadFile(sumFile); err == nil && exists && string(prev) == sum {
+		return nil
+	}
+
+	klog.Infof("Ansible target: %s, installing requirements from %s", ans.Name, ans.Requirements)
+	if err := detectOrFetchImage(conn, ansibleImage, false); err != nil {
+		return err
+	}
+	containerPath, err := ans.repoPath(ans.Requirements)
+	if err != nil {
+		return err
+	}
+	s := specgen.NewSpecGenerator(ansibleImage, false)
+	s.Name = "ansible-galaxy-" + ans.Name
+	s.Command = []string{"/usr/bin/ansible-galaxy", "install", "--force", "-r", containerPath}
+	s.Env = galaxyEnv()
+	s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"ro"}}, {Name: ans.galaxyVolume(), Dest: ansibleGalaxyDir, Options: []string{"rw"}}}
+	s.NetNS = specgen.Namespace{
+		NSMode: "host",
+		Value:  "",
+	}
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return err
+	}
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("ansible-galaxy install -r %s failed with exit code %d: %s", ans.Requirements, exitCode, output)
+	}
+	if err := os.MkdirAll(filepath.Dir(sumFile), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(sumFile, []byte(sum), 0644)
+}
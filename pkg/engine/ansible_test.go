@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlaybookArgs(t *testing.T) {
+	forks := 5
+	ans := &Ansible{
+		Inventory: []interface{}{"web1", "web2"},
+		ExtraVars: map[string]interface{}{"port": 8080},
+		Tags:      []string{"config", "web"},
+		Limit:     "web1; rm -rf /",
+		CheckMode: true,
+		Forks:     &forks,
+	}
+	ans.target = &Target{url: "https://github.com/containers/fetchit.git"}
+	args, err := ans.playbookArgs("/opt/fetchit/examples/ansible/site.yml")
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	expected := []string{
+		"-e", "ansible_connection=ssh",
+		"-i", "web1,web2,",
+		"-e", `{"port":8080}`,
+		"--tags", "config,web",
+		"--limit", "web1; rm -rf /",
+		"--check",
+		"--forks", "5",
+		"--", "/opt/fetchit/examples/ansible/site.yml",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Failed: %v != %v", args, expected)
+	}
+
+	ans = &Ansible{Inventory: "inventory/hosts", ExtraVars: "vars/prod.yml"}
+	ans.target = &Target{url: "https://github.com/containers/fetchit.git"}
+	args, err = ans.playbookArgs("site.yml")
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	expected = []string{"-e", "ansible_connection=ssh", "-i", "/opt/fetchit/inventory/hosts", "-e", "@/opt/fetchit/vars/prod.yml", "--", "site.yml"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Failed: %v != %v", args, expected)
+	}
+
+	ans.VaultPasswordFile = "/etc/fetchit/vault-password"
+	args, err = ans.playbookArgs("site.yml")
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	expected = []string{"-e", "ansible_connection=ssh", "-i", "/opt/fetchit/inventory/hosts", "-e", "@/opt/fetchit/vars/prod.yml", "--vault-password-file", ansibleVaultPass, "--", "site.yml"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Failed: %v != %v", args, expected)
+	}
+
+	ans.Inventory = "../../etc/ansible/hosts"
+	if _, err := ans.playbookArgs("site.yml"); err == nil {
+		t.Fatalf("Failed: expected error for inventory outside of the repository")
+	}
+}
+
+func TestWatched(t *testing.T) {
+	ans := &Ansible{Playbook: []string{"site.yml"}}
+	if !ans.watched([]string{"roles/web/templates/nginx.conf.j2"}) {
+		t.Fatalf("Failed: every change should be watched without watchPaths")
+	}
+	if ans.watched(nil) {
+		t.Fatalf("Failed: no changes should not be watched")
+	}
+	ans.WatchPaths = []string{"roles/web/", "site.yml"}
+	tests := map[string]bool{
+		"roles/web/tasks/main.yml": true,
+		"site.yml":                 true,
+		"roles/webserver/main.yml": false,
+		"group_vars/all.yml":       false,
+	}
+	for name, expected := range tests {
+		if ans.watched([]string{name}) != expected {
+			t.Fatalf("Failed: watched(%s) != %v", name, expected)
+		}
+	}
+}
+
+func TestParseAnsibleRecap(t *testing.T) {
+	output := `[WARNING]: provided hosts list is empty
+{
+    "custom_stats": {},
+    "plays": [],
+    "stats": {
+        "web1": {"changed": 2, "failures": 0, "ignored": 0, "ok": 5, "rescued": 0, "skipped": 1, "unreachable": 0},
+        "web2": {"changed": 0, "failures": 0, "ignored": 0, "ok": 0, "rescued": 0, "skipped": 0, "unreachable": 1}
+    }
+}
+`
+	hosts, err := parseAnsibleRecap(output)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if hosts["web1"].Ok != 5 || hosts["web1"].Changed != 2 || hosts["web2"].Unreachable != 1 {
+		t.Fatalf("Failed: unexpected stats %+v %+v", hosts["web1"], hosts["web2"])
+	}
+	recap := &AnsibleRecap{Playbook: "site.yml", Hosts: hosts}
+	if !recap.Failed() {
+		t.Fatalf("Failed: unreachable host should fail the recap")
+	}
+
+	if _, err := parseAnsibleRecap("ERROR! the playbook could not be found"); err == nil {
+		t.Fatalf("Failed: expected error without json output")
+	}
+}
+
+func TestPlaybookArgsPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		inventory string
+		extraVars string
+		playbook  string
+		expected  []string
+		err       bool
+	}{
+		{
+			name:      "relative to targetPath",
+			inventory: "inventory/hosts",
+			extraVars: "vars/prod.yml",
+			playbook:  "/opt/fetchit/examples/ansible/site.yml",
+			expected:  []string{"-e", "ansible_connection=ssh", "-i", "/opt/fetchit/examples/ansible/inventory/hosts", "-e", "@/opt/fetchit/examples/ansible/vars/prod.yml", "--", "/opt/fetchit/examples/ansible/site.yml"},
+		},
+		{
+			name:      "elsewhere in the repository",
+			inventory: "../inventory",
+			playbook:  "site.yml",
+			expected:  []string{"-e", "ansible_connection=ssh", "-i", "/opt/fetchit/examples/inventory", "--", "site.yml"},
+		},
+		{
+			name:     "playbook that looks like an option",
+			playbook: "--syntax-check",
+			expected: []string{"-e", "ansible_connection=ssh", "--", "--syntax-check"},
+		},
+		{
+			name:      "inventory outside of the repository",
+			inventory: "../../../etc/ansible/hosts",
+			playbook:  "site.yml",
+			err:       true,
+		},
+		{
+			name:      "absolute vars file",
+			extraVars: "/etc/ansible/vars.yml",
+			playbook:  "site.yml",
+			err:       true,
+		},
+	}
+	for _, tt := range tests {
+		ans := &Ansible{CommonMethod: CommonMethod{TargetPath: "examples/ansible"}}
+		if tt.inventory != "" {
+			ans.Inventory = tt.inventory
+		}
+		if tt.extraVars != "" {
+			ans.ExtraVars = tt.extraVars
+		}
+		ans.target = &Target{url: "https://github.com/containers/fetchit.git"}
+		args, err := ans.playbookArgs(tt.playbook)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Failed %s: expected error, got %v", tt.name, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed %s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Errorf("Failed %s: %v != %v", tt.name, args, tt.expected)
+		}
+		if args[len(args)-2] != "--" {
+			t.Errorf("Failed %s: playbook not preceded by --: %v", tt.name, args)
+		}
+	}
+}
+
+func TestParseAnsibleRecapOutputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		hosts  map[string]*AnsibleHostStats
+		err    bool
+	}{
+		{
+			name:   "json only",
+			output: `{"plays": [], "stats": {"localhost": {"ok": 3, "changed": 1}}}`,
+			hosts:  map[string]*AnsibleHostStats{"localhost": {Ok: 3, Changed: 1}},
+		},
+		{
+			name:   "after warnings",
+			output: "[WARNING]: no inventory was parsed\n[WARNING]: provided hosts list is empty\n" + `{"stats": {"web1": {"failures": 1}}}` + "\n",
+			hosts:  map[string]*AnsibleHostStats{"web1": {Failures: 1}},
+		},
+		{
+			name:   "no hosts",
+			output: `{"plays": [], "stats": {}}`,
+			hosts:  map[string]*AnsibleHostStats{},
+		},
+		{
+			name:   "no json",
+			output: "ERROR! the playbook: site.yml could not be found\n",
+			err:    true,
+		},
+		{
+			name:   "truncated json",
+			output: "\n{\"stats\": {\"web1\": ",
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		hosts, err := parseAnsibleRecap(tt.output)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Failed %s: expected error, got %v", tt.name, hosts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed %s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(hosts, tt.hosts) {
+			t.Errorf("Failed %s: unexpected stats %v", tt.name, hosts)
+		}
+	}
+}
+
+func TestAnsibleFailures(t *testing.T) {
+	output := `[WARNING]: provided hosts list is empty
+{
+    "plays": [{
+        "tasks": [
+            {"task": {"name": "set facts"}, "hosts": {"web1": {"changed": false, "ansible_facts": {"db_password": "vault-secret"}}}},
+            {"task": {"name": "start nginx"}, "hosts": {
+                "web2": {"failed": true, "msg": "Unable to start service nginx"},
+                "web1": {"changed": true, "db_password": "vault-secret"}
+            }},
+            {"task": {"name": "ping"}, "hosts": {"web3": {"unreachable": true, "msg": "Failed to connect to the host via ssh"}}}
+        ]
+    }],
+    "stats": {"web2": {"failures": 1}, "web3": {"unreachable": 1}}
+}
+`
+	expected := []string{
+		`web2: task "start nginx": Unable to start service nginx`,
+		`web3: task "ping": Failed to connect to the host via ssh`,
+	}
+	failures := ansibleFailures(output)
+	if !reflect.DeepEqual(failures, expected) {
+		t.Fatalf("Failed: %v != %v", failures, expected)
+	}
+
+	long := "ERROR! " + strings.Repeat("x", 2*maxAnsibleMessage)
+	failures = ansibleFailures(long)
+	if len(failures) != 1 || len(failures[0]) != maxAnsibleMessage+3 || !strings.HasPrefix(failures[0], "...") {
+		t.Fatalf("Failed: output without json should be truncated, got %d bytes", len(failures[0]))
+	}
+}
@@ -39,8 +39,9 @@ func applyChanges(ctx context.Context, target *Target, targetPath string, globPa
 	return changeMap, nil
 }
 
-//getLatest will get the head of the branch in the repository specified by the target's url
-func getLatest(target *Target) (plumbing.Hash, error) {
+//getLatest will get the head of the branch in the repository specified by the target's url,
+//fetching with the target's own credentials or the PAT
+func getLatest(target *Target, PAT string) (plumbing.Hash, error) {
 	directory := getDirectory(target)
 
 	repo, err := git.PlainOpen(directory)
@@ -49,10 +50,12 @@ func getLatest(target *Target) (plumbing.Hash, error) {
 	}
 
 	refSpec := config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/heads/%s", target.branch, target.branch))
-	if err = repo.Fetch(&git.FetchOptions{
+	fetchOptions := &git.FetchOptions{
 		RefSpecs: []config.RefSpec{refSpec, "HEAD:refs/heads/HEAD"},
 		Force:    true,
-	}); err != nil && err != git.NoErrAlreadyUpToDate && !target.disconnected {
+		Auth:     target.gitAuth(PAT),
+	}
+	if err = repo.Fetch(fetchOptions); err != nil && err != git.NoErrAlreadyUpToDate && !target.disconnected {
 		return plumbing.Hash{}, utils.WrapErr(err, "Error fetching branch %s from remote repository %s", target.branch, target.url)
 	}
 
@@ -63,7 +66,7 @@ func getLatest(target *Target) (plumbing.Hash, error) {
 
 	wt, err := repo.Worktree()
 	if err != nil {
-		return plumbing.Hash{}, utils.WrapErr(err, "Error getting reference to worktree for repository", directory)
+		return plumbing.Hash{}, utils.WrapErr(err, "Error getting reference to worktree for repository %s", directory)
 	}
 
 	if err := wt.Checkout(&git.CheckoutOptions{Hash: branch.Hash()}); err != nil {
@@ -153,20 +156,12 @@ func getFilteredChangeMap(
 
 	changes, err := currentTree.Diff(desiredTree)
 	if err != nil {
-		return nil, utils.WrapErr(err, "Error getting diff between current and latest", targetPath)
+		return nil, utils.WrapErr(err, "Error getting diff between current and latest in %s", targetPath)
 	}
 
-	var g glob.Glob
-	if globPattern == nil {
-		g, err = glob.Compile("**")
-		if err != nil {
-			return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", globPattern)
-		}
-	} else {
-		g, err = glob.Compile(*globPattern)
-		if err != nil {
-			return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", globPattern)
-		}
+	g, err := compileGlob(globPattern)
+	if err != nil {
+		return nil, err
 	}
 
 	changeMap := make(map[*object.Change]string)
@@ -182,6 +177,19 @@ func getFilteredChangeMap(
 	return changeMap, nil
 }
 
+// compileGlob compiles a method's glob, matching everything if none is set
+func compileGlob(globPattern *string) (glob.Glob, error) {
+	pattern := "**"
+	if globPattern != nil {
+		pattern = *globPattern
+	}
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", pattern)
+	}
+	return g, nil
+}
+
 func checkTag(tags *[]string, name string) bool {
 	if tags == nil {
 		return true
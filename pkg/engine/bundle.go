@@ -0,0 +1,468 @@
+package engine
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/pkg/compression"
+	"k8s.io/klog/v2"
+)
+
+const (
+	bundleCacheDir        = "/opt/.cache/bundles"
+	defaultBundleMaxSize  = 2 << 30
+	defaultBundleMaxFiles = 100000
+)
+
+// Bundle configures how a disconnected target's archive is verified and unpacked
+type Bundle struct {
+	// Sha256 is the expected checksum of the archive
+	Sha256 string `mapstructure:"sha256"`
+	// ChecksumUrl is a sha256sum manifest listing the archive
+	ChecksumUrl string `mapstructure:"checksumUrl"`
+	// SignatureUrl is a detached OpenPGP signature of the archive
+	SignatureUrl string `mapstructure:"signatureUrl"`
+	// PublicKey is an armored OpenPGP public key file, read from the fetchit container, that signs the archive
+	PublicKey string `mapstructure:"publicKey"`
+	// MaxSize is the most bytes the unpacked archive may hold, 2GiB by default
+	MaxSize int64 `mapstructure:"maxSize"`
+	// MaxFiles is the most entries the archive may hold, 100000 by default
+	MaxFiles int `mapstructure:"maxFiles"`
+}
+
+// fetchBundle downloads, verifies and applies the archive of a disconnected target. A git bundle is
+// fetched into the existing clone, and is downloaded again only when the server reports a change.
+// Any other archive replaces the working repository, and is not fetched again until the url has
+// been unreachable, which is how a new snapshot is signalled.
+func fetchBundle(target *Target) error {
+	directory := getDirectory(target)
+	cache := "/opt/.cache/" + directory + "/"
+	dest := cache + "HEAD"
+
+	state, err := loadBundleState(directory)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dest); err == nil && state == nil {
+		resp, err := http.Head(target.url)
+		if err != nil {
+			// remove the diff file
+			if err := os.Remove(dest); err != nil {
+				klog.Info("Failed to remove file ", dest)
+				return err
+			}
+			klog.Info("URL not present...requeuing")
+			return nil
+		}
+		resp.Body.Close()
+		klog.Info("No changes since last disonnected run...requeuing")
+		return nil
+	}
+
+	b := target.bundle
+	if b == nil {
+		b = &Bundle{}
+	}
+	expected, err := b.expectedSHA256(target.url)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(bundleCacheDir, 0700); err != nil {
+		return err
+	}
+	archive := filepath.Join(bundleCacheDir, path.Base(target.url))
+	source, err := downloadFile(target.url, archive, expected, state)
+	if err != nil {
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			klog.Info("URL not present...requeuing")
+			return nil
+		}
+		return err
+	}
+	if source == nil {
+		klog.Info("No changes since last disonnected run...requeuing")
+		return nil
+	}
+	defer os.Remove(archive)
+	klog.Infof("loading disconnected archive from %s", target.url)
+
+	if err := b.verifySignature(archive); err != nil {
+		return utils.WrapErr(err, "Bundle %s failed signature verification", target.url)
+	}
+	if expected == "" && b.SignatureUrl == "" {
+		klog.Warningf("Bundle %s is not verified, set a checksum or signature for the target's bundle", target.url)
+	}
+	if isGitBundle(archive) {
+		return applyGitBundleOnce(target, archive, source)
+	}
+	if err := importBundle(archive, directory, b); err != nil {
+		return utils.WrapErr(err, "Error importing bundle %s", target.url)
+	}
+	return createDiffFile(directory)
+}
+
+// expectedSHA256 returns the configured checksum of the archive, reading it from the checksum manifest if one is set
+func (b *Bundle) expectedSHA256(url string) (string, error) {
+	if b.Sha256 != "" || b.ChecksumUrl == "" {
+		return strings.ToLower(b.Sha256), nil
+	}
+	manifest, err := httpGetLimited(b.ChecksumUrl, 1<<20)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error fetching checksum manifest %s", b.ChecksumUrl)
+	}
+	return parseChecksumManifest(manifest, path.Base(url))
+}
+
+// parseChecksumManifest finds the checksum of name in sha256sum output. A manifest of a single
+// checksum without a file name is accepted too.
+func parseChecksumManifest(manifest []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	var lines [][]string
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		lines = append(lines, fields)
+		// sha256sum marks binary mode with a * before the file name
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if len(lines) == 1 && len(lines[0]) == 1 {
+		return strings.ToLower(lines[0][0]), nil
+	}
+	return "", fmt.Errorf("no checksum for %s in manifest", name)
+}
+
+// verifySignature checks the archive against a detached OpenPGP signature, if one is configured
+func (b *Bundle) verifySignature(archive string) error {
+	if b.SignatureUrl == "" {
+		return nil
+	}
+	if b.PublicKey == "" {
+		return fmt.Errorf("signatureUrl requires publicKey")
+	}
+	keyFile, err := os.Open(b.PublicKey)
+	if err != nil {
+		return err
+	}
+	defer keyFile.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(keyFile)
+	if err != nil {
+		return utils.WrapErr(err, "Error reading public key %s", b.PublicKey)
+	}
+	sig, err := httpGetLimited(b.SignatureUrl, 1<<20)
+	if err != nil {
+		return utils.WrapErr(err, "Error fetching signature %s", b.SignatureUrl)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, f, bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, f, bytes.NewReader(sig), nil)
+	}
+	return err
+}
+
+func httpGetLimited(url string, limit int64) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// importBundle unpacks a zip or tar archive, optionally compressed, into a staging directory and
+// replaces directory with the git repository found in it. Entries escaping the staging directory,
+// directly or through symlinks, and archives over the size limits are rejected before the working
+// repository is touched.
+func importBundle(archive, directory string, b *Bundle) error {
+	staging := filepath.Join(bundleCacheDir, directory+".new")
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	// entries are unpacked below a directory of the target's name, as they were when bundles
+	// were unpacked over the working repository, so entries such as ../fetchit/README.md still work
+	base := filepath.Join(staging, directory)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return err
+	}
+	x := &bundleExtractor{root: staging, base: base, maxSize: b.MaxSize, maxFiles: b.MaxFiles}
+	if x.maxSize <= 0 {
+		x.maxSize = defaultBundleMaxSize
+	}
+	if x.maxFiles <= 0 {
+		x.maxFiles = defaultBundleMaxFiles
+	}
+	if err := x.extract(archive); err != nil {
+		return err
+	}
+
+	repo, err := findRepository(base)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+	old := filepath.Join(bundleCacheDir, directory+".old")
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if _, err := os.Stat(abs); err == nil {
+		if err := os.Rename(abs, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(repo, abs); err != nil {
+		// put the previous repository back
+		os.Rename(old, abs)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// findRepository returns dir if it is a git repository, or its only subdirectory if that is
+func findRepository(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return dir, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		sub := filepath.Join(dir, entries[0].Name())
+		if _, err := os.Stat(filepath.Join(sub, ".git")); err == nil {
+			return sub, nil
+		}
+	}
+	return "", fmt.Errorf("bundle does not contain a git repository")
+}
+
+type bundleExtractor struct {
+	// root is the staging directory nothing may be written outside of
+	root string
+	// base is the directory entry names are relative to
+	base     string
+	maxSize  int64
+	maxFiles int
+	size     int64
+	files    int
+}
+
+func (x *bundleExtractor) extract(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return utils.WrapErr(err, "Error reading %s", archive)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		return x.extractZip(archive)
+	}
+	_, decompressor, reader, err := compression.DetectCompressionFormat(f)
+	if err != nil {
+		return err
+	}
+	if decompressor != nil {
+		rc, err := decompressor(reader)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		reader = rc
+	}
+	return x.extractTar(reader)
+}
+
+func (x *bundleExtractor) extractZip(archive string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return utils.WrapErr(err, "Error opening zip file %s", archive)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.mkdir(f.Name, mode)
+		case mode&os.ModeSymlink != 0:
+			var target []byte
+			target, err = readZipEntry(f, 4096)
+			if err == nil {
+				err = x.symlink(f.Name, string(target))
+			}
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			rc, err = f.Open()
+			if err == nil {
+				err = x.writeFile(f.Name, mode, rc)
+				rc.Close()
+			}
+		default:
+			err = fmt.Errorf("unsupported entry %s", f.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readZipEntry(f *zip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, limit))
+}
+
+func (x *bundleExtractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return utils.WrapErr(err, "Error reading tar archive")
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(hdr.Name, mode)
+		case tar.TypeSymlink:
+			err = x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.writeFile(hdr.Name, mode, tr)
+		case tar.TypeXGlobalHeader:
+		default:
+			err = fmt.Errorf("unsupported entry %s of type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// path resolves an entry name, rejecting names that escape the staging directory or
+// would be written through a symlink unpacked earlier
+func (x *bundleExtractor) path(name string) (string, error) {
+	x.files++
+	if x.files > x.maxFiles {
+		return "", fmt.Errorf("bundle has more than %d entries", x.maxFiles)
+	}
+	p, err := utils.SafeJoin(x.base, filepath.FromSlash(name))
+	if err != nil || !utils.IsWithin(x.root, p) {
+		return "", fmt.Errorf("bundle entry %s escapes the repository", name)
+	}
+	rel, err := filepath.Rel(x.root, filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	dir := x.root
+	if rel != "." {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, part)
+			fi, err := os.Lstat(dir)
+			if os.IsNotExist(err) {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return "", fmt.Errorf("bundle entry %s is below symlink %s", name, dir)
+			}
+		}
+	}
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("bundle entry %s overwrites a symlink", name)
+	}
+	return p, nil
+}
+
+func (x *bundleExtractor) mkdir(name string, mode os.FileMode) error {
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, mode.Perm()|0700)
+}
+
+func (x *bundleExtractor) symlink(name, target string) error {
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	// the target is resolved through the symlinks unpacked so far, as l1/../.. may
+	// read as staying within the repository while l1 itself points elsewhere
+	resolved, err := utils.ResolveWithin(x.root, filepath.Dir(p), target)
+	if err != nil || !utils.IsWithin(x.base, resolved) {
+		return fmt.Errorf("bundle symlink %s -> %s escapes the repository", name, target)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+func (x *bundleExtractor) writeFile(name string, mode os.FileMode, r io.Reader) error {
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	// read one byte past the remaining allowance to detect oversized bundles
+	n, err := io.Copy(f, io.LimitReader(r, x.maxSize-x.size+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return utils.WrapErr(err, "Error writing %s", name)
+	}
+	x.size += n
+	if x.size > x.maxSize {
+		return fmt.Errorf("bundle is larger than %d bytes", x.maxSize)
+	}
+	return nil
+}
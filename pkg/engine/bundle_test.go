@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type bundleEntry struct {
+	name     string
+	body     string
+	linkname string
+}
+
+func writeTarGz(t *testing.T, path string, entries []bundleEntry) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.linkname != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.linkname, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+}
+
+func writeZip(t *testing.T, path string, entries []bundleEntry) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		w.Write([]byte(e.body))
+	}
+	zw.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+}
+
+func newTestExtractor(t *testing.T) *bundleExtractor {
+	root := t.TempDir()
+	base := filepath.Join(root, "fetchit")
+	if err := os.MkdirAll(base, 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	return &bundleExtractor{root: root, base: base, maxSize: 1024, maxFiles: 10}
+}
+
+func TestBundleExtractor(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.zip")
+	writeZip(t, good, []bundleEntry{{name: "../fetchit/.git/HEAD", body: "ref: refs/heads/main\n"}, {name: "README.md", body: "fetchit"}})
+	x := newTestExtractor(t)
+	if err := x.extract(good); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if repo, err := findRepository(x.base); err != nil || repo != x.base {
+		t.Fatalf("Failed: repository not found in %s: %v", x.base, err)
+	}
+
+	tests := map[string][]bundleEntry{
+		"traversal":      {{name: "../../etc/passwd", body: "root"}},
+		"absolute":       {{name: "/etc/passwd", body: "root"}},
+		"symlink escape": {{name: "etc", linkname: "../../../etc"}},
+		"through symlink": {
+			{name: "docs", linkname: "README.md"},
+			{name: "docs/passwd", body: "root"},
+		},
+		"chained symlink": {
+			{name: "x/y/l1", linkname: "../.."},
+			{name: "x/y/a", linkname: "l1/../../.."},
+		},
+		"too large": {{name: "big", body: strings.Repeat("a", 2048)}},
+	}
+	for name, entries := range tests {
+		archive := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".tar.gz")
+		writeTarGz(t, archive, entries)
+		x := newTestExtractor(t)
+		if err := x.extract(archive); err == nil {
+			t.Fatalf("Failed: expected error for %s", name)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(x.root), "etc", "passwd")); err == nil {
+			t.Fatalf("Failed: %s wrote outside of the staging directory", name)
+		}
+	}
+}
+
+func TestParseChecksumManifest(t *testing.T) {
+	manifest := []byte("0123abcd  other.zip\nABCDEF01 *fetchit.zip\n")
+	sum, err := parseChecksumManifest(manifest, "fetchit.zip")
+	if err != nil || sum != "abcdef01" {
+		t.Fatalf("Failed: %s, %v", sum, err)
+	}
+	if _, err := parseChecksumManifest(manifest, "missing.zip"); err == nil {
+		t.Fatalf("Failed: expected error for missing file")
+	}
+	if sum, err := parseChecksumManifest([]byte("abcdef01\n"), "fetchit.zip"); err != nil || sum != "abcdef01" {
+		t.Fatalf("Failed: %s, %v", sum, err)
+	}
+}
@@ -0,0 +1,737 @@
+package engine
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+const (
+	bundleManifest       = "SHA256SUMS"
+	defaultImagesArchive = "images.tar"
+	signingPassphraseEnv = "FETCHIT_SIGNING_PASSPHRASE"
+)
+
+// bundleOptions are the flags of fetchit bundle
+type bundleOptions struct {
+	config          string
+	output          string
+	sources         []string
+	gitBundle       bool
+	since           string
+	signingKey      string
+	authFile        string
+	signaturePolicy string
+	arch            string
+}
+
+var bundleOpts = &bundleOptions{}
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Build update media for disconnected targets",
+	Long: `Build a directory, or a tar archive of one, holding everything the disconnected targets of a
+fetchit config need: a snapshot or git bundle of each repository, the images used by their raw
+and kube files, the config file for configReload and a SHA256SUMS manifest, optionally signed.`,
+	Example: `  fetchit bundle --config config.yaml --source fetchit=https://github.com/containers/fetchit --output /media/usb`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cobra.CheckErr(bundleOpts.run(context.Background()))
+	},
+}
+
+func init() {
+	flags := bundleCmd.Flags()
+	flags.StringVarP(&bundleOpts.config, "config", "c", "", "fetchit config file to build the bundle for")
+	flags.StringVarP(&bundleOpts.output, "output", "o", "", "directory to write, or a .tar, .tar.gz or .tgz archive")
+	flags.StringArrayVar(&bundleOpts.sources, "source", nil, "git repository of a disconnected target as name=url, where name is the target's name or repository directory")
+	flags.BoolVar(&bundleOpts.gitBundle, "git-bundle", false, "write git bundles instead of repository snapshots for device targets")
+	flags.StringVar(&bundleOpts.since, "since", "", "commit or tag the disconnected site already has, git bundles only carry newer commits")
+	flags.StringVar(&bundleOpts.signingKey, "signing-key", "", "armored OpenPGP private key to sign the manifest and archives with, its passphrase is read from $"+signingPassphraseEnv)
+	flags.StringVar(&bundleOpts.authFile, "authfile", "", "registry auth file, as used by podman login")
+	flags.StringVar(&bundleOpts.signaturePolicy, "signature-policy", "", "containers-policy.json images must satisfy, the system policy by default")
+	flags.StringVar(&bundleOpts.arch, "arch", runtime.GOARCH, "architecture of the images to bundle")
+	bundleCmd.MarkFlagRequired("config")
+	bundleCmd.MarkFlagRequired("output")
+	fetchitCmd.AddCommand(bundleCmd)
+}
+
+func (o *bundleOptions) run(ctx context.Context) error {
+	configBytes, err := ioutil.ReadFile(o.config)
+	if err != nil {
+		return err
+	}
+	config, err := readConfigFile(o.config)
+	if err != nil {
+		return err
+	}
+	sources, err := parseSources(o.sources)
+	if err != nil {
+		return err
+	}
+
+	work, err := os.MkdirTemp("", "fetchit-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	out := o.output
+	archiveOutput := isTarOutput(o.output)
+	if archiveOutput {
+		out = filepath.Join(work, "out")
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	var refs []string
+	for _, tc := range config.TargetConfigs {
+		if !tc.Disconnected {
+			continue
+		}
+		images, err := o.bundleTarget(tc, config.PAT, sources, work, out)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, images...)
+	}
+	for _, i := range config.Images {
+		refs = append(refs, i.References...)
+	}
+	if err := o.bundleImages(ctx, config.Images, uniqueImages(refs), work, out); err != nil {
+		return err
+	}
+	if err := bundleConfig(config.ConfigReload, configBytes, out); err != nil {
+		return err
+	}
+
+	if err := o.writeManifest(out); err != nil {
+		return err
+	}
+	if archiveOutput {
+		if err := writeArchive(out, "", o.output); err != nil {
+			return err
+		}
+	}
+	klog.Infof("Bundle written to %s", o.output)
+	return nil
+}
+
+// readConfigFile reads a fetchit config the way fetchit start does, merged with its config sources
+func readConfigFile(file string) (*FetchitConfig, error) {
+	merged, err := loadConfig(file)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading config file %s", file)
+	}
+	if err := merged.resolveRefs(); err != nil {
+		return nil, err
+	}
+	return merged.validate()
+}
+
+func parseSources(flags []string) (map[string]string, error) {
+	sources := make(map[string]string)
+	for _, s := range flags {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid source %q, expected name=url", s)
+		}
+		sources[kv[0]] = kv[1]
+	}
+	return sources, nil
+}
+
+func isTarOutput(output string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(output, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleTarget clones the target's source and writes it as the target reads it: an archive named after
+// the url of an HTTP target and a directory or git bundle named after the target on a device. It returns
+// the images used by the target's raw and kube files.
+func (o *bundleOptions) bundleTarget(tc *TargetConfig, pat string, sources map[string]string, work, out string) ([]string, error) {
+	target := &Target{name: tc.Name, url: tc.Url, device: tc.Device, branch: tc.Branch}
+	directory := getDirectory(target)
+	key := tc.Name
+	if key == "" {
+		key = directory
+	}
+	source, ok := sources[key]
+	if !ok {
+		return nil, fmt.Errorf("no source for disconnected target %s, set one with --source %s=<git url>", key, key)
+	}
+	clone := filepath.Join(work, "repos", directory)
+	head, err := cloneSource(source, tc.Branch, pat, clone)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Bundling %s at %s for target %s", source, head, directory)
+
+	if tc.Url != "" {
+		name := path.Base(tc.Url)
+		if strings.HasSuffix(name, ".bundle") {
+			err = writeGitBundle(clone, tc.Branch, o.since, filepath.Join(out, name))
+		} else {
+			err = writeArchive(clone, directory, filepath.Join(out, name))
+		}
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error writing %s", name)
+		}
+	}
+	if tc.Device != "" {
+		switch {
+		case o.gitBundle && directory == ".":
+			return nil, fmt.Errorf("git bundles require the device target to have a name")
+		case o.gitBundle:
+			err = writeGitBundle(clone, tc.Branch, o.since, filepath.Join(out, directory+".bundle"))
+		default:
+			err = copyFromDevice(clone, filepath.Join(out, directory))
+		}
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error writing %s for device target", directory)
+		}
+	}
+	return targetImages(clone, head, tc)
+}
+
+func cloneSource(source, branch, pat, dest string) (plumbing.Hash, error) {
+	var user string
+	if pat != "" {
+		user = "fetchit"
+	}
+	repo, err := git.PlainClone(dest, false, &git.CloneOptions{
+		Auth: &githttp.BasicAuth{
+			Username: user,
+			Password: pat,
+		},
+		URL:           source,
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		SingleBranch:  true,
+	})
+	if err != nil {
+		return plumbing.ZeroHash, utils.WrapErr(err, "Error cloning %s", source)
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+// targetImages returns the images of the files the target's raw and kube methods would deploy at head
+func targetImages(directory string, head plumbing.Hash, tc *TargetConfig) ([]string, error) {
+	var images []string
+	for _, r := range tc.Raw {
+		paths, err := methodFiles(directory, head, r.TargetPath, r.Glob, rawFileTags)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			if len(strings.TrimSpace(string(b))) == 0 {
+				continue
+			}
+			raw, err := rawPodFromBytes(b)
+			if err != nil {
+				return nil, utils.WrapErr(err, "Error reading %s", p)
+			}
+			images = append(images, raw.Image)
+		}
+	}
+	for _, k := range tc.Kube {
+		paths, err := methodFiles(directory, head, k.TargetPath, k.Glob, kubeFileTags)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			pods, err := podFromBytes(b)
+			if err != nil {
+				return nil, utils.WrapErr(err, "Error reading %s", p)
+			}
+			for _, pod := range pods {
+				for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+					images = append(images, c.Image)
+				}
+			}
+		}
+	}
+	return images, nil
+}
+
+// methodFiles lists the files under targetPath that a method with glob and tags deploys
+func methodFiles(directory string, head plumbing.Hash, targetPath string, glob *string, tags []string) ([]string, error) {
+	tree, err := getSubTreeFromHash(directory, head, targetPath)
+	if err != nil {
+		return nil, err
+	}
+	changeMap, err := getFilteredChangeMap(directory, targetPath, glob, &object.Tree{}, tree, &tags)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, p := range changeMap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// uniqueImages normalizes image references and removes duplicates
+func uniqueImages(refs []string) []string {
+	seen := make(map[string]bool)
+	var images []string
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		if r, err := parseImageReference(ref); err == nil {
+			ref = r.String()
+		}
+		if !seen[ref] {
+			seen[ref] = true
+			images = append(images, ref)
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+// bundleImages writes the images into one docker-archive, placed wherever an image target reads
+// archives from: its imagePath on a device and the file name of its url over HTTP
+func (o *bundleOptions) bundleImages(ctx context.Context, targets []*Image, refs []string, work, out string) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	var dests []string
+	for _, i := range targets {
+		if i.Device != "" && i.ImagePath != "" {
+			dests = append(dests, i.ImagePath)
+		}
+		if i.Url != "" {
+			dests = append(dests, path.Base(i.Url))
+		}
+	}
+	if len(dests) == 0 {
+		klog.Warningf("No image target reads an image archive, writing %s, which must be loaded manually", defaultImagesArchive)
+		dests = append(dests, defaultImagesArchive)
+	}
+
+	tmp := filepath.Join(work, defaultImagesArchive)
+	if err := o.writeImageArchive(ctx, refs, tmp); err != nil {
+		return err
+	}
+	for _, dest := range dests {
+		target, err := utils.SafeJoin(out, dest)
+		if err != nil {
+			return err
+		}
+		if err := copyFromDevice(tmp, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *bundleOptions) writeImageArchive(ctx context.Context, refs []string, dest string) error {
+	sys := &types.SystemContext{AuthFilePath: o.authFile, ArchitectureChoice: o.arch}
+	var policy *signature.Policy
+	var err error
+	if o.signaturePolicy != "" {
+		policy, err = signature.NewPolicyFromFile(o.signaturePolicy)
+	} else {
+		policy, err = signature.DefaultPolicy(sys)
+	}
+	if err != nil {
+		return utils.WrapErr(err, "Error reading signature policy")
+	}
+	pc, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return err
+	}
+	defer pc.Destroy()
+
+	w, err := archive.NewWriter(sys, dest)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		r, err := parseImageReference(ref)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		var named reference.Named = r.Named
+		var tagged reference.NamedTagged
+		if r.Tag != "" {
+			tagged, err = reference.WithTag(r.Named, r.Tag)
+			named = tagged
+		} else {
+			klog.Warningf("%s is pinned to a digest, it is loaded untagged and must be referred to by image ID", ref)
+			named, err = reference.WithDigest(r.Named, r.Digest)
+		}
+		if err != nil {
+			w.Close()
+			return err
+		}
+		srcRef, err := docker.NewReference(named)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		destRef, err := w.NewReference(tagged)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		klog.Infof("Bundling image %s", ref)
+		if _, err := copy.Image(ctx, pc, destRef, srcRef, &copy.Options{SourceCtx: sys}); err != nil {
+			w.Close()
+			return utils.WrapErr(err, "Error copying image %s", ref)
+		}
+	}
+	return w.Close()
+}
+
+// bundleConfig writes the config where configReload reads it, at configPath on its device and
+// at the file name of its configURL
+func bundleConfig(c *ConfigReload, configBytes []byte, out string) error {
+	if c == nil {
+		return nil
+	}
+	var dests []string
+	if c.Device != "" && c.ConfigPath != "" {
+		dests = append(dests, c.ConfigPath)
+	}
+	if c.ConfigURL != "" {
+		dests = append(dests, path.Base(c.ConfigURL))
+	}
+	for _, dest := range dests {
+		target, err := utils.SafeJoin(out, dest)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, configBytes, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifest lists the checksum of every file in out in SHA256SUMS and, with a signing key,
+// writes detached signatures of the manifest and of every file at the top of out, which is what
+// targets served over HTTP verify
+func (o *bundleOptions) writeManifest(out string) error {
+	var lines []string
+	var top []string
+	err := filepath.Walk(out, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(out, p)
+		if err != nil {
+			return err
+		}
+		if rel == bundleManifest || strings.HasSuffix(rel, ".asc") {
+			return nil
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s", sum, filepath.ToSlash(rel)))
+		if filepath.Dir(rel) == "." {
+			top = append(top, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	manifest := filepath.Join(out, bundleManifest)
+	if err := os.WriteFile(manifest, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	if o.signingKey == "" {
+		return nil
+	}
+	signer, err := readSigningKey(o.signingKey, os.Getenv(signingPassphraseEnv))
+	if err != nil {
+		return err
+	}
+	for _, p := range append(top, manifest) {
+		if err := signFile(signer, p); err != nil {
+			return utils.WrapErr(err, "Error signing %s", p)
+		}
+	}
+	return nil
+}
+
+// readSigningKey reads the first private key of an armored key ring, decrypting it with passphrase
+func readSigningKey(file, passphrase string) (*openpgp.Entity, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading signing key %s", file)
+	}
+	for _, e := range keyring {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, utils.WrapErr(err, "Error decrypting signing key %s, set $%s", file, signingPassphraseEnv)
+			}
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				if err := sub.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, utils.WrapErr(err, "Error decrypting signing key %s", file)
+				}
+			}
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("%s does not contain a private key", file)
+}
+
+func signFile(signer *openpgp.Entity, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(file + ".asc")
+	if err != nil {
+		return err
+	}
+	if err := openpgp.ArmoredDetachSign(out, signer, in, nil); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeGitBundle writes branch of the repository in directory as a git bundle, as git bundle create
+// would. With since, only the commits since it are bundled and it becomes a prerequisite.
+func writeGitBundle(directory, branch, since, dest string) error {
+	repo, err := git.PlainOpen(directory)
+	if err != nil {
+		return err
+	}
+	refName := plumbing.NewBranchReferenceName(branch)
+	ref, err := repo.Reference(refName, true)
+	if err != nil {
+		return utils.WrapErr(err, "Error reading %s", refName)
+	}
+
+	var prerequisites []*object.Commit
+	if since != "" {
+		hash, err := repo.ResolveRevision(plumbing.Revision(since))
+		if err != nil {
+			return utils.WrapErr(err, "Error resolving %s", since)
+		}
+		commit, err := repo.CommitObject(*hash)
+		if err != nil {
+			return err
+		}
+		prerequisites = append(prerequisites, commit)
+	}
+	var ignore []plumbing.Hash
+	for _, c := range prerequisites {
+		ignore = append(ignore, c.Hash)
+	}
+	objects, err := revlist.Objects(repo.Storer, []plumbing.Hash{ref.Hash()}, ignore)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, gitBundleV2)
+	for _, c := range prerequisites {
+		fmt.Fprintf(w, "-%s %s\n", c.Hash, strings.SplitN(c.Message, "\n", 2)[0])
+	}
+	fmt.Fprintf(w, "%s %s\n\n", ref.Hash(), refName)
+	if _, err := packfile.NewEncoder(w, repo.Storer, false).Encode(objects, 10); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeArchive archives dir as a zip or tar, compressed according to the extension of dest.
+// Entries are placed below prefix, if set.
+func writeArchive(dir, prefix, dest string) (err error) {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dest)
+		}
+	}()
+	if prefix == "." {
+		prefix = ""
+	}
+
+	if strings.HasSuffix(dest, ".zip") {
+		zw := zip.NewWriter(f)
+		if err := walkArchive(dir, prefix, func(name string, fi os.FileInfo, link string, r io.Reader) error {
+			hdr, err := zip.FileInfoHeader(fi)
+			if err != nil {
+				return err
+			}
+			hdr.Name = name
+			if fi.IsDir() {
+				hdr.Name += "/"
+			} else {
+				hdr.Method = zip.Deflate
+			}
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if link != "" {
+				_, err = io.WriteString(w, link)
+			} else if r != nil {
+				_, err = io.Copy(w, r)
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	var w io.WriteCloser
+	switch {
+	case strings.HasSuffix(dest, ".tar"):
+		w = nopWriteCloser{f}
+	case strings.HasSuffix(dest, ".tar.gz"), strings.HasSuffix(dest, ".tgz"):
+		w, err = compression.CompressStream(f, compression.Gzip, nil)
+	case strings.HasSuffix(dest, ".tar.zst"):
+		w, err = compression.CompressStream(f, compression.Zstd, nil)
+	default:
+		return fmt.Errorf("unsupported archive %s, use .zip, .tar, .tar.gz, .tgz or .tar.zst", dest)
+	}
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if err := walkArchive(dir, prefix, func(name string, fi os.FileInfo, link string, r io.Reader) error {
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if r != nil {
+			_, err = io.Copy(tw, r)
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// walkArchive calls add for every directory, file and symlink below dir, with its name in the archive
+func walkArchive(dir, prefix string, add func(name string, fi os.FileInfo, link string, r io.Reader) error) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if name == "." || name == "" {
+			return nil
+		}
+		switch {
+		case fi.IsDir():
+			return add(name, fi, "", nil)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return add(name, fi, link, nil)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return add(name, fi, "", f)
+		default:
+			return nil
+		}
+	})
+}
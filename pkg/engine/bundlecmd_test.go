@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func commitFile(t *testing.T, repo *git.Repository, dir, name, content string) plumbing.Hash {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if _, err := wt.Add(name); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	hash, err := wt.Commit("add "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "fetchit", Email: "fetchit@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	return hash
+}
+
+func TestWriteGitBundle(t *testing.T) {
+	src := t.TempDir()
+	repo, err := git.PlainInit(src, false)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	first := commitFile(t, repo, src, "a.json", "{}")
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	branch := head.Name().Short()
+
+	full := filepath.Join(t.TempDir(), "full.bundle")
+	if err := writeGitBundle(src, branch, "", full); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	dest := filepath.Join(t.TempDir(), "fetchit")
+	if hash, err := applyGitBundle(dest, full, branch); err != nil || hash != first {
+		t.Fatalf("Failed: applied %s, %v", hash, err)
+	}
+
+	second := commitFile(t, repo, src, "b.json", "{}")
+	incremental := filepath.Join(t.TempDir(), "incremental.bundle")
+	if err := writeGitBundle(src, branch, first.String(), incremental); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if _, err := applyGitBundle(filepath.Join(t.TempDir(), "empty"), incremental, branch); err == nil {
+		t.Fatalf("Failed: expected error applying an incremental bundle without a clone")
+	}
+	if hash, err := applyGitBundle(dest, incremental, branch); err != nil || hash != second {
+		t.Fatalf("Failed: applied %s, %v", hash, err)
+	}
+}
+
+func TestUniqueImages(t *testing.T) {
+	images := uniqueImages([]string{"nginx", "docker.io/library/nginx:latest", "", "quay.io/fetchit/fetchit:v1"})
+	if len(images) != 2 || images[0] != "docker.io/library/nginx:latest" || images[1] != "quay.io/fetchit/fetchit:v1" {
+		t.Fatalf("Failed: unexpected images %v", images)
+	}
+}
@@ -56,6 +56,7 @@ func zeroToCurrent(ctx, conn context.Context, m Method, target *Target, tag *[]s
 
 	if current != plumbing.ZeroHash {
 		err = m.Apply(ctx, conn, plumbing.ZeroHash, current, tag)
+		recordStatus(m, current.String(), err)
 		if err != nil {
 			return fmt.Errorf("Failed to apply changes: %v", err)
 		}
@@ -66,21 +67,36 @@ func zeroToCurrent(ctx, conn context.Context, m Method, target *Target, tag *[]s
 	return nil
 }
 
+// getDirectory is where the target's repository is cloned, named after its url, or after its name
+// for a device target, unless the target sets its own path. A device target without a name uses the
+// root of the device.
 func getDirectory(target *Target) string {
+	if target.localPath != "" {
+		return target.localPath
+	}
+	if target.url == "" && target.name != "" {
+		return target.name
+	}
 	trimDir := strings.TrimSuffix(target.url, path.Ext(target.url))
 	return filepath.Base(trimDir)
 }
 
-func currentToLatest(ctx, conn context.Context, m Method, target *Target, tag *[]string) error {
+func currentToLatest(ctx, conn context.Context, m Method, target *Target, PAT string, tag *[]string) error {
 	directory := getDirectory(target)
 	if target.disconnected {
+		var err error
 		if len(target.url) > 0 {
-			extractZip(target.url)
+			err = fetchBundle(target)
 		} else if len(target.device) > 0 {
-			localDevicePull(directory, target.device, "", false)
+			err = fetchDeviceRepository(target)
+		}
+		if err != nil {
+			klog.Errorf("Failed to fetch disconnected target %s: %v", directory, err)
+			recordStatus(m, "", err)
+			return fmt.Errorf("Failed to fetch disconnected target: %v", err)
 		}
 	}
-	latest, err := getLatest(target)
+	latest, err := getLatest(target, PAT)
 	if err != nil {
 		return fmt.Errorf("Failed to get latest commit: %v", err)
 	}
@@ -91,7 +107,9 @@ func currentToLatest(ctx, conn context.Context, m Method, target *Target, tag *[
 	}
 
 	if latest != current {
-		if err := m.Apply(ctx, conn, current, latest, tag); err != nil {
+		err := m.Apply(ctx, conn, current, latest, tag)
+		recordStatus(m, latest.String(), err)
+		if err != nil {
 			return fmt.Errorf("Failed to apply changes: %v", err)
 		}
 		updateCurrent(ctx, target, latest, m.GetKind(), m.GetName())
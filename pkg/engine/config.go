@@ -11,7 +11,7 @@ import (
 	"os"
 	"time"
 
-	"github.com/containers/podman/v4/pkg/bindings"
+	"github.com/containers/fetchit/pkg/engine/utils"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"k8s.io/klog/v2"
@@ -23,13 +23,18 @@ const configFileMethod = "config"
 // $FETCHIT_CONFIG_URL environment variable or a local file with a ConfigReload target
 // at ~/.fetchit/config.yaml will inform fetchit to use this target.
 // Without this target, fetchit will not watch for config updates.
-// At this time, only 1 FetchitConfigReload target can be passed to fetchit
-// TODO: Collect multiple from multiple FetchitTargets and merge configs into 1 on disk
+// Only one config may set ConfigReload, which also reloads the config when any of its configSources change
 type ConfigReload struct {
 	CommonMethod `mapstructure:",squash"`
 	ConfigURL    string `mapstructure:"configURL"`
 	Device       string `mapstructure:"device"`
 	ConfigPath   string `mapstructure:"configPath"`
+	// Git is a repository holding the config, which takes precedence over ConfigURL and Device
+	Git *ConfigGit `mapstructure:"git"`
+	// gitState is the config from Git in effect
+	gitState *configGitState
+	// pendingGitState is a config read from Git that has not loaded yet
+	pendingGitState *configGitState
 }
 
 func (c *ConfigReload) GetKind() string {
@@ -50,27 +55,62 @@ func (c *ConfigReload) Process(ctx, conn context.Context, PAT string, skew int)
 	}
 	os.Setenv("FETCHIT_CONFIG_URL", envURL)
 	// If ConfigURL is not populated, warn and leave
-	if envURL == "" && c.Device == "" {
+	if envURL == "" && c.Device == "" && c.Git == nil && !fetchitConfig.hasSources {
 		klog.Warningf("Fetchit ConfigReload found, but neither $FETCHIT_CONFIG_URL on system nor ConfigReload.ConfigURL are set, exiting without updating the config.")
 	}
 	// CheckForConfigUpdates downloads & places config file in defaultConfigPath
 	// if the downloaded config file differs from what's currently on the system.
-	if envURL != "" {
-		restart := checkForConfigUpdates(envURL, true, false)
-		if !restart {
-			return
+	// replaced is set when a new config file was placed at defaultConfigPath, rather than one of
+	// its configSources changing
+	var replaced bool
+	if c.Git != nil {
+		var err error
+		replaced, err = c.checkForGitUpdates(PAT)
+		if err != nil {
+			klog.Errorf("Error checking config repository %s: %v", c.Git.Url, err)
 		}
-		klog.Info("Updated config processed, restarting with new targets")
-		fetchitConfig.Restart()
+		recordStatus(c, c.gitCommit(), err)
+	} else if envURL != "" {
+		replaced = checkForConfigUpdates(envURL, true, false)
 	} else if c.Device != "" {
-		restart := checkForDisconUpdates(c.Device, c.ConfigPath, true, false)
-		if !restart {
-			return
+		replaced = checkForDisconUpdates(c.Device, c.ConfigPath, true, false)
+	}
+	restart := replaced
+	if !restart && fetchitConfig.hasSources {
+		restart = configSourcesChanged()
+	}
+	if !restart {
+		return
+	}
+	klog.Info("Updated config processed, restarting with new targets")
+	err := fetchitConfig.Restart()
+	c.gitApplied(err)
+	if err != nil {
+		// the current config keeps running, put its file back so a restart of fetchit loads it too
+		if replaced {
+			rejectConfig(err)
+		} else {
+			rejectMergedConfig(err)
 		}
-		klog.Info("Updated config processed, restarting with new targets")
-		fetchitConfig.Restart()
+	} else {
+		clearRejectedConfig()
 	}
+	recordStatus(c, c.gitCommit(), err)
+}
 
+// configSourcesChanged reads every config source again and reports whether the effective config changed
+func configSourcesChanged() bool {
+	merged, err := loadConfig(defaultConfigPath)
+	if err != nil {
+		klog.Errorf("Error reading config sources, keeping the current config: %v", err)
+		return false
+	}
+	hash, err := merged.hash()
+	if err != nil {
+		klog.Errorf("Error reading config sources, keeping the current config: %v", err)
+		return false
+	}
+	return hash != fetchitConfig.configHash && !isRejectedConfig(hash)
 }
 
 func (c *ConfigReload) MethodEngine(ctx, conn context.Context, change *object.Change, path string) error {
@@ -99,57 +139,47 @@ func checkForConfigUpdates(envURL string, existsAlready bool, initial bool) bool
 
 // CheckForDisconUpdates identifies if the device is connected and if a cache file exists
 func checkForDisconUpdates(device, configPath string, existsAlready bool, initial bool) bool {
-	ctx := context.Background()
 	name := "fetchit-config"
 	cache := "/opt/.cache/" + name
 	dest := cache + "/" + "config.yaml"
-	conn, err := bindings.NewConnection(ctx, "unix://run/podman/podman.sock")
-	if err != nil {
-		klog.Error("Failed to create connection to podman")
-		return false
-	}
 	// Ensure that the device is present
-	_, exitCode, err := localDeviceCheck(name, device, "")
+	present, err := localDeviceCheck(device)
 	if err != nil {
-		klog.Error("Failed to check device")
+		klog.Errorf("Failed to check device: %v", err)
 		return false
 	}
-	if exitCode != 0 {
+	if !present {
 		// remove the diff file
-		err = os.Remove(dest)
+		os.Remove(dest)
 		klog.Info("Device not present...requeuing")
 		return false
-	} else if exitCode == 0 {
-		if _, err := os.Stat(dest); os.IsNotExist(err) {
-			// make the cache directory
-			err = os.MkdirAll(cache, 0755)
-			copyFile := ("/mnt/" + configPath + " " + dest)
-			s := generateDeviceSpec(filetransferMethod, "disconnected-", copyFile, device, name)
-			createResponse, err := createAndStartContainer(conn, s)
-			if err != nil {
-				return false
-			}
-			// Wait for the container to finish
-			waitAndRemoveContainer(conn, createResponse.ID)
-			klog.Info("container created", createResponse.ID)
-			currentConfigBytes, err := ioutil.ReadFile(defaultConfigPath)
-			newBytes, err := ioutil.ReadFile(dest)
-			if err != nil {
-				klog.Error("Failed to read config file")
-			} else {
-				if bytes.Equal(newBytes, currentConfigBytes) {
-					return false
-				} else {
-					// Replace the old config file at defaultConfigPath with the new one from dest and restart
-					os.WriteFile(defaultConfigBackup, currentConfigBytes, 0600)
-					os.WriteFile(defaultConfigPath, newBytes, 0600)
-					klog.Infof("Current config backup placed at %s", defaultConfigBackup)
-					return true
-				}
-			}
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		return false
+	}
+	present, err = withDevice(device, func(mountPoint string) error {
+		src, err := utils.SafeJoin(mountPoint, configPath)
+		if err != nil {
+			return err
 		}
+		return copyFromDevice(src, dest)
+	})
+	if err != nil || !present {
+		klog.Errorf("Failed to copy config file %s from device %s: %v", configPath, device, err)
+		return false
 	}
-	return false
+	newBytes, err := ioutil.ReadFile(dest)
+	if err != nil {
+		klog.Error("Failed to read config file")
+		return false
+	}
+	// Replace the old config file at defaultConfigPath with the new one from dest and restart
+	changed, err := replaceConfig(newBytes)
+	if err != nil {
+		klog.Error(err)
+		return false
+	}
+	return changed
 }
 
 // downloadUpdateConfig returns true if config was updated in fetchit pod
@@ -171,7 +201,7 @@ func downloadUpdateConfigFile(urlStr string, existsAlready, initial bool) (bool,
 	defer resp.Body.Close()
 	newBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return false, fmt.Errorf("error downloading config from %s: %v", err)
+		return false, fmt.Errorf("error downloading config from %s: %v", urlStr, err)
 	}
 	if newBytes == nil {
 		// if initial, this is the last resort, newBytes should be populated
@@ -188,6 +218,9 @@ func downloadUpdateConfigFile(urlStr string, existsAlready, initial bool) (bool,
 			if bytes.Equal(newBytes, currentConfigBytes) {
 				return false, nil
 			}
+			if isRejectedConfig(configBytesHash(newBytes)) {
+				return false, nil
+			}
 		}
 
 		if existsAlready {
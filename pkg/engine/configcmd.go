@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var configFile string
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the fetchit config",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var configViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Print the effective config",
+	Long: `Print the config fetchit runs with, merged from the config file, its conf.d directory and its
+configSources, with the source of each target as a comment`,
+	Run: func(cmd *cobra.Command, args []string) {
+		merged, err := loadConfig(configFile)
+		cobra.CheckErr(err)
+		cobra.CheckErr(merged.view(os.Stdout))
+	},
+}
+
+func init() {
+	configCmd.PersistentFlags().StringVarP(&configFile, "config", "c", defaultConfigPath, "fetchit config file")
+	configCmd.AddCommand(configViewCmd)
+	fetchitCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+var configRejectedPath = filepath.Join("/opt", ".cache", "config-rejected.json")
+
+// rejectedConfig is the last config that failed to load, which is not applied again until it changes
+type rejectedConfig struct {
+	// Hash is the checksum of the config file, or of the merged config when a config source changed
+	Hash  string    `json:"hash"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// configReloadStatus is reported with the status of ConfigReload
+type configReloadStatus struct {
+	*configGitState
+	Rejected *rejectedConfig `json:"rejected,omitempty"`
+}
+
+func configBytesHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func loadRejectedConfig() *rejectedConfig {
+	b, err := ioutil.ReadFile(configRejectedPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Unable to read %s: %v", configRejectedPath, err)
+		}
+		return nil
+	}
+	rejected := &rejectedConfig{}
+	if err := json.Unmarshal(b, rejected); err != nil {
+		klog.Warningf("Unable to read %s: %v", configRejectedPath, err)
+		return nil
+	}
+	return rejected
+}
+
+// isRejectedConfig reports whether hash is the config that was last rejected
+func isRejectedConfig(hash string) bool {
+	rejected := loadRejectedConfig()
+	if rejected == nil || rejected.Hash != hash {
+		return false
+	}
+	klog.Infof("Config %s was rejected at %s, not applying it again until it changes: %s", hash, rejected.Time.Format(time.RFC3339), rejected.Error)
+	return true
+}
+
+func saveRejectedConfig(hash string, loadErr error) {
+	b, err := json.Marshal(&rejectedConfig{Hash: hash, Error: loadErr.Error(), Time: time.Now().UTC()})
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(configRejectedPath), 0700); err == nil {
+			err = os.WriteFile(configRejectedPath, b, 0600)
+		}
+	}
+	if err != nil {
+		klog.Warningf("Unable to record rejected config %s: %v", hash, err)
+	}
+}
+
+// clearRejectedConfig forgets the rejected config once a config loads
+func clearRejectedConfig() {
+	if err := os.Remove(configRejectedPath); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Unable to remove %s: %v", configRejectedPath, err)
+	}
+}
+
+// rejectConfig remembers the config file at defaultConfigPath, which failed to load with loadErr, so
+// it is not applied again until it changes, and puts the backup of the previous config back in its
+// place. It reports whether the backup was restored.
+func rejectConfig(loadErr error) bool {
+	current, err := ioutil.ReadFile(defaultConfigPath)
+	if err == nil {
+		saveRejectedConfig(configBytesHash(current), loadErr)
+	}
+	backup, err := ioutil.ReadFile(defaultConfigBackup)
+	if err != nil {
+		klog.Errorf("Config at %s was rejected and there is no backup to restore: %v", defaultConfigPath, loadErr)
+		return false
+	}
+	if bytes.Equal(backup, current) {
+		klog.Errorf("Config at %s was rejected and is the same as its backup: %v", defaultConfigPath, loadErr)
+		return false
+	}
+	if err := os.WriteFile(defaultConfigPath, backup, 0600); err != nil {
+		klog.Errorf("Config at %s was rejected and restoring %s failed: %v", defaultConfigPath, defaultConfigBackup, err)
+		return false
+	}
+	klog.Errorf("Config at %s was rejected, restored the previous config from %s: %v", defaultConfigPath, defaultConfigBackup, loadErr)
+	return true
+}
+
+// rejectMergedConfig remembers the merged config, changed by one of its config sources, that failed
+// to load with loadErr. The config file did not change, so there is nothing to restore.
+func rejectMergedConfig(loadErr error) {
+	merged, err := loadConfig(defaultConfigPath)
+	if err != nil {
+		klog.Errorf("Config sources were rejected: %v", loadErr)
+		return
+	}
+	hash, err := merged.hash()
+	if err != nil {
+		klog.Errorf("Config sources were rejected: %v", loadErr)
+		return
+	}
+	saveRejectedConfig(hash, loadErr)
+	klog.Errorf("Config sources were rejected, keeping the current config: %v", loadErr)
+}
+
+func (c *ConfigReload) statusDetails() interface{} {
+	status := &configReloadStatus{
+		configGitState: c.gitState,
+		Rejected:       loadRejectedConfig(),
+	}
+	if status.configGitState == nil && status.Rejected == nil {
+		return nil
+	}
+	return status
+}
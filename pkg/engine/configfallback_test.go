@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRejectConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath, backupPath, rejectedPath := defaultConfigPath, defaultConfigBackup, configRejectedPath
+	defer func() {
+		defaultConfigPath, defaultConfigBackup, configRejectedPath = configPath, backupPath, rejectedPath
+	}()
+	defaultConfigPath = filepath.Join(dir, "config.yaml")
+	defaultConfigBackup = filepath.Join(dir, "config-backup.yaml")
+	configRejectedPath = filepath.Join(dir, "cache", "config-rejected.json")
+
+	good := []byte("targetConfigs: []\n")
+	bad := []byte("targetConfigs: [\n")
+	if err := os.WriteFile(defaultConfigPath, good, 0600); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	changed, err := replaceConfig(bad)
+	if err != nil || !changed {
+		t.Fatalf("Failed: expected the config to be replaced: %v", err)
+	}
+
+	if !rejectConfig(errors.New("yaml: line 2: did not find expected node content")) {
+		t.Fatalf("Failed: expected the backup to be restored")
+	}
+	if b, _ := os.ReadFile(defaultConfigPath); string(b) != string(good) {
+		t.Fatalf("Failed: expected the previous config, got %q", b)
+	}
+	if !isRejectedConfig(configBytesHash(bad)) || isRejectedConfig(configBytesHash(good)) {
+		t.Fatalf("Failed: expected only the broken config to be rejected")
+	}
+	if changed, err := replaceConfig(bad); err != nil || changed {
+		t.Fatalf("Failed: rejected config was applied again: %v", err)
+	}
+	status := (&ConfigReload{}).statusDetails().(*configReloadStatus)
+	if status.Rejected == nil || status.Rejected.Hash != configBytesHash(bad) {
+		t.Fatalf("Failed: rejected config missing from status: %+v", status)
+	}
+
+	clearRejectedConfig()
+	if changed, err := replaceConfig(bad); err != nil || !changed {
+		t.Fatalf("Failed: config was not applied after the rejection was cleared: %v", err)
+	}
+}
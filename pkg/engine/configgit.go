@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/klog/v2"
+)
+
+var (
+	configGitDir = filepath.Join(".cache", "config-git")
+	// configGitStateDir holds the state and history of the config read from git
+	configGitStateDir = filepath.Join("/opt", configGitDir)
+)
+
+// ConfigGit is a git repository holding the fetchit config
+type ConfigGit struct {
+	// Url of the repository
+	Url string `mapstructure:"url"`
+	// Branch to follow, main by default
+	Branch string `mapstructure:"branch"`
+	// Path of the config file in the repository, config.yaml by default
+	Path string `mapstructure:"path"`
+	// Username and Password, or a token, to clone with. The pat of the config is used if they are not set
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// PasswordFile is read from the fetchit container instead of setting Password
+	PasswordFile string `mapstructure:"passwordFile"`
+	// PublicKey is an armored OpenPGP public key file, read from the fetchit container,
+	// that the commit of the config must be signed with
+	PublicKey string `mapstructure:"publicKey"`
+}
+
+// configGitState is the config last read from git, kept with every config read for audit
+type configGitState struct {
+	Url    string    `json:"url"`
+	Branch string    `json:"branch"`
+	Path   string    `json:"path"`
+	Commit string    `json:"commit"`
+	Blob   string    `json:"blob"`
+	Signer string    `json:"signer,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// configGitRecord is an entry of the history of configs read from git
+type configGitRecord struct {
+	*configGitState
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (g *ConfigGit) branch() string {
+	if g.Branch == "" {
+		return "main"
+	}
+	return g.Branch
+}
+
+func (g *ConfigGit) path() string {
+	if g.Path == "" {
+		return "config.yaml"
+	}
+	return g.Path
+}
+
+// target is the repository as a target, cloned below the cache so it never shares a clone with a
+// target of the same url, which may follow another branch
+func (g *ConfigGit) target() (*Target, error) {
+	password := g.Password
+	if g.PasswordFile != "" {
+		b, err := ioutil.ReadFile(g.PasswordFile)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error reading password file %s", g.PasswordFile)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	sum := sha256.Sum256([]byte(g.Url + "@" + g.branch()))
+	return &Target{
+		url:       g.Url,
+		branch:    g.branch(),
+		localPath: filepath.Join(configGitDir, hex.EncodeToString(sum[:8])),
+		username:  g.Username,
+		password:  password,
+	}, nil
+}
+
+// checkForGitUpdates fetches the config repository and replaces the config when the blob of the
+// config file changed, reporting whether the config changed
+func (c *ConfigReload) checkForGitUpdates(PAT string) (bool, error) {
+	g := c.Git
+	if g.Url == "" {
+		return false, fmt.Errorf("configReload git requires a url")
+	}
+	target, err := g.target()
+	if err != nil {
+		return false, err
+	}
+	if err := getClone(target, PAT); err != nil {
+		return false, utils.WrapErr(err, "Error cloning config repository %s", g.Url)
+	}
+	head, err := getLatest(target, PAT)
+	if err != nil {
+		return false, err
+	}
+
+	repo, err := git.PlainOpen(getDirectory(target))
+	if err != nil {
+		return false, err
+	}
+	commit, err := repo.CommitObject(head)
+	if err != nil {
+		return false, err
+	}
+	var signer string
+	if g.PublicKey != "" {
+		if signer, err = verifyCommitSignature(commit, g.PublicKey); err != nil {
+			return false, utils.WrapErr(err, "Config commit %s failed signature verification", head)
+		}
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return false, err
+	}
+	file, err := tree.File(g.path())
+	if err != nil {
+		return false, utils.WrapErr(err, "Error finding %s at commit %s", g.path(), head)
+	}
+
+	previous, err := loadConfigGitState()
+	if err != nil {
+		return false, err
+	}
+	state := &configGitState{
+		Url:    g.Url,
+		Branch: g.branch(),
+		Path:   g.path(),
+		Commit: head.String(),
+		Blob:   file.Hash.String(),
+		Signer: signer,
+		Time:   time.Now().UTC(),
+	}
+	if previous != nil && previous.Blob == state.Blob && previous.Url == state.Url && previous.Path == state.Path {
+		c.gitState = state
+		return false, nil
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return false, err
+	}
+	if isRejectedConfig(configBytesHash([]byte(contents))) {
+		return false, nil
+	}
+	changed, err := replaceConfig([]byte(contents))
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		// the config in the repository is already the local config
+		c.gitState = state
+		return false, saveConfigGitState(state)
+	}
+	klog.Infof("Config %s changed to blob %s at commit %s of %s", state.Path, state.Blob, state.Commit, state.Url)
+	// the state is recorded once the config loads, see gitApplied
+	c.pendingGitState = state
+	return true, nil
+}
+
+// gitCommit is the commit of the config from git in effect
+func (c *ConfigReload) gitCommit() string {
+	if c.gitState == nil {
+		return ""
+	}
+	return c.gitState.Commit
+}
+
+// gitApplied records the config last read from git once it has loaded, or as rejected with the
+// error it failed to load with, in which case the config in effect is still the previous one
+func (c *ConfigReload) gitApplied(loadErr error) {
+	state := c.pendingGitState
+	if state == nil {
+		return
+	}
+	c.pendingGitState = nil
+	if loadErr == nil {
+		c.gitState = state
+		if err := saveConfigGitState(state); err != nil {
+			klog.Warningf("Unable to record config commit %s: %v", state.Commit, err)
+		}
+	}
+	if err := appendConfigGitHistory(state, loadErr); err != nil {
+		klog.Warningf("Unable to record config commit %s in history: %v", state.Commit, err)
+	}
+}
+
+// verifyCommitSignature checks the OpenPGP signature of commit against the keys in keyFile and
+// returns the signer's identity
+func verifyCommitSignature(commit *object.Commit, keyFile string) (string, error) {
+	if commit.PGPSignature == "" {
+		return "", fmt.Errorf("commit %s is not signed", commit.Hash)
+	}
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error reading public key %s", keyFile)
+	}
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return "", err
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		return "", err
+	}
+	entity, err := openpgp.CheckArmoredDetachedSignature(keyring, r, strings.NewReader(commit.PGPSignature), nil)
+	if err != nil {
+		return "", err
+	}
+	for name := range entity.Identities {
+		return name, nil
+	}
+	return entity.PrimaryKey.KeyIdString(), nil
+}
+
+// replaceConfig writes a new config over defaultConfigPath, keeping the current one at
+// defaultConfigBackup, and reports whether the config changed
+func replaceConfig(newBytes []byte) (bool, error) {
+	currentConfigBytes, err := ioutil.ReadFile(defaultConfigPath)
+	if err == nil {
+		if bytes.Equal(newBytes, currentConfigBytes) {
+			return false, nil
+		}
+		if isRejectedConfig(configBytesHash(newBytes)) {
+			return false, nil
+		}
+		if err := os.WriteFile(defaultConfigBackup, currentConfigBytes, 0600); err != nil {
+			return false, fmt.Errorf("could not copy %s to path %s: %v", defaultConfigPath, defaultConfigBackup, err)
+		}
+		klog.Infof("Current config backup placed at %s", defaultConfigBackup)
+	}
+	if err := os.WriteFile(defaultConfigPath, newBytes, 0600); err != nil {
+		return false, fmt.Errorf("unable to write new config contents, reverting to old config: %v", err)
+	}
+	return true, nil
+}
+
+func configGitStatePath() string {
+	return filepath.Join(configGitStateDir, "state.json")
+}
+
+func loadConfigGitState() (*configGitState, error) {
+	b, err := os.ReadFile(configGitStatePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &configGitState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveConfigGitState records the config read from git as the config in effect
+func saveConfigGitState(state *configGitState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(configGitStateDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(configGitStatePath(), b, 0600)
+}
+
+// appendConfigGitHistory appends a config read from git to history.jsonl next to the state, as
+// applied, or as rejected with the error it failed to load with
+func appendConfigGitHistory(state *configGitState, loadErr error) error {
+	record := &configGitRecord{configGitState: state, Applied: loadErr == nil}
+	if loadErr != nil {
+		record.Error = loadErr.Error()
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(configGitStateDir, 0700); err != nil {
+		return err
+	}
+	history, err := os.OpenFile(filepath.Join(configGitStateDir, "history.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := history.Write(append(b, '\n')); err != nil {
+		history.Close()
+		return err
+	}
+	return history.Close()
+}
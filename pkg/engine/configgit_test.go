@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func signedCommit(t *testing.T, signer *openpgp.Entity, message string) *object.Commit {
+	sig := object.Signature{Name: "fetchit", Email: "fetchit@example.com", When: time.Unix(1660000000, 0)}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: message}
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, signer, r, nil); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	commit.PGPSignature = b.String()
+	return commit
+}
+
+func TestVerifyCommitSignature(t *testing.T) {
+	signer, err := openpgp.NewEntity("fetchit", "", "fetchit@example.com", nil)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "config.asc")
+	f, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := signer.Serialize(w); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	w.Close()
+	f.Close()
+
+	commit := signedCommit(t, signer, "update config\n")
+	if name, err := verifyCommitSignature(commit, keyFile); err != nil || name != "fetchit <fetchit@example.com>" {
+		t.Fatalf("Failed: signer %q, %v", name, err)
+	}
+
+	commit.Message = "tampered\n"
+	if _, err := verifyCommitSignature(commit, keyFile); err == nil {
+		t.Fatalf("Failed: expected error for a modified commit")
+	}
+	commit.PGPSignature = ""
+	if _, err := verifyCommitSignature(commit, keyFile); err == nil {
+		t.Fatalf("Failed: expected error for an unsigned commit")
+	}
+}
+
+func TestConfigGitApplied(t *testing.T) {
+	defer func(prev string) { configGitStateDir = prev }(configGitStateDir)
+	configGitStateDir = t.TempDir()
+
+	c := &ConfigReload{pendingGitState: &configGitState{Commit: "bad"}}
+	c.gitApplied(fmt.Errorf("invalid config"))
+	if state, err := loadConfigGitState(); err != nil || state != nil || c.gitState != nil {
+		t.Fatalf("Failed: rejected commit recorded as current: %v, %v", state, err)
+	}
+	c.pendingGitState = &configGitState{Commit: "good"}
+	c.gitApplied(nil)
+	if state, err := loadConfigGitState(); err != nil || state == nil || state.Commit != "good" || c.gitState.Commit != "good" {
+		t.Fatalf("Failed: applied commit not recorded: %v, %v", state, err)
+	}
+
+	history, err := os.ReadFile(filepath.Join(configGitStateDir, "history.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(history)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"commit":"bad"`) || !strings.Contains(lines[0], `"applied":false,"error":"invalid config"`) ||
+		!strings.Contains(lines[1], `"commit":"good"`) || !strings.Contains(lines[1], `"applied":true`) {
+		t.Fatalf("Failed: unexpected history %s", history)
+	}
+}
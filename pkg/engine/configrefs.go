@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	fileRefPrefix   = "file:"
+	secretRefPrefix = "podman-secret:"
+	// values shorter than this are not redacted, as they would hide unrelated parts of every log line
+	minRedactedLength = 4
+)
+
+var (
+	// envRefPattern matches ${NAME} references to environment variables, and $${NAME} escaping them
+	envRefPattern = regexp.MustCompile(`\$\$?\{[A-Za-z_][A-Za-z0-9_]*\}`)
+	// podmanSecretsDir is where podman mounts the secrets passed to the fetchit container with --secret
+	podmanSecretsDir = filepath.Join("/run", "secrets")
+
+	logRedactor = &redactor{w: os.Stderr}
+)
+
+// literalKeys are the keys, in lower case, whose values are passed on as they are written, so ${NAME}
+// in them is left to playbooks, templates and commands. File and podman secret references are resolved.
+var literalKeys = map[string]bool{"vars": true, "extravars": true, "command": true}
+
+// isConfigRef reports whether a config value is resolved when the config is loaded
+func isConfigRef(s string) bool {
+	return isFileRef(s) || strings.HasPrefix(s, secretRefPrefix) || envRefPattern.MatchString(s)
+}
+
+// isValueRef reports whether a config value is replaced as a whole by what it references
+func isValueRef(s string) bool {
+	return isFileRef(s) || strings.HasPrefix(s, secretRefPrefix)
+}
+
+// isFileRef reports whether a config value is a file:/path reference. file:// is a url, such as
+// the file:///srv/repo.git url of a target, and is left as it is.
+func isFileRef(s string) bool {
+	return strings.HasPrefix(s, fileRefPrefix+"/") && !strings.HasPrefix(s, fileRefPrefix+"//")
+}
+
+// resolveConfigString resolves the references in a config value: the value is the contents of the file
+// at file:/path, or of the podman secret at podman-secret:name, and each ${NAME} in it is replaced by
+// the environment variable NAME, unless written $${NAME}. It returns the value and the values that are
+// secrets: those read from files and podman secrets, and the environment variables of a credential.
+func resolveConfigString(s string, credential bool) (string, []string, error) {
+	switch {
+	case isFileRef(s):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(s, fileRefPrefix))
+		if err != nil {
+			return s, nil, err
+		}
+		value := strings.TrimRight(string(b), "\r\n")
+		return value, []string{value}, nil
+	case strings.HasPrefix(s, secretRefPrefix):
+		name := strings.TrimPrefix(s, secretRefPrefix)
+		if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return s, nil, fmt.Errorf("invalid podman secret name %q", name)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(podmanSecretsDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return s, nil, fmt.Errorf("podman secret %s not found in %s, pass it to the fetchit container with --secret %s", name, podmanSecretsDir, name)
+			}
+			return s, nil, err
+		}
+		value := strings.TrimRight(string(b), "\r\n")
+		return value, []string{value}, nil
+	}
+	var values []string
+	var missing []string
+	resolved := envRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		if credential {
+			values = append(values, value)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return s, nil, fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return resolved, values, nil
+}
+
+// resolveRefs resolves the references in every string value of the config into the values it is
+// decoded from, and redacts the secrets read from logs. Values below literalKeys only resolve file and
+// podman secret references. The merged values, which are hashed, viewed and backed up, keep the references.
+func (m *mergedConfig) resolveRefs() error {
+	var errs configErrors
+	var secrets []string
+	var resolve func(v interface{}, path []interface{}, literal bool) interface{}
+	resolve = func(v interface{}, path []interface{}, literal bool) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			out := make(map[string]interface{}, len(v))
+			for k, item := range v {
+				out[k] = resolve(item, append(path[:len(path):len(path)], k), literal || literalKeys[strings.ToLower(k)])
+			}
+			return out
+		case []interface{}:
+			out := make([]interface{}, len(v))
+			for i, item := range v {
+				out[i] = resolve(item, append(path[:len(path):len(path)], i), literal)
+			}
+			return out
+		case string:
+			if literal && !isValueRef(v) {
+				return v
+			}
+			key, _ := path[len(path)-1].(string)
+			value, read, err := resolveConfigString(v, credentialKeys[strings.ToLower(key)])
+			if err != nil {
+				source, node := m.locate(path)
+				errs.add(source, node, "%s: %v", refPath(path), err)
+			}
+			secrets = append(secrets, read...)
+			return value
+		}
+		return v
+	}
+	m.resolved = resolve(m.values, nil, false).(map[string]interface{})
+	logRedactor.add(secrets...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// locate finds the source and node of a value in the merged config
+func (m *mergedConfig) locate(path []interface{}) (string, *yaml.Node) {
+	key := strings.ToLower(fmt.Sprint(path[0]))
+	if len(path) > 1 {
+		i, _ := path[1].(int)
+		switch {
+		case key == "targetconfigs" && i < len(m.targetNodes):
+			return m.targetSources[i], nodeAt(m.targetNodes[i], path[2:]...)
+		case key == "images" && i < len(m.imageNodes):
+			return m.imageSources[i], nodeAt(m.imageNodes[i], path[2:]...)
+		}
+	}
+	return m.keySources[key], nodeAt(m.keyNodes[key], path[1:]...)
+}
+
+func refPath(path []interface{}) string {
+	var b strings.Builder
+	for _, p := range path {
+		if i, ok := p.(int); ok {
+			fmt.Fprintf(&b, "[%d]", i)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(".")
+		}
+		fmt.Fprint(&b, p)
+	}
+	return b.String()
+}
+
+// redactor replaces the values resolved from config references in everything written through it
+type redactor struct {
+	mu      sync.RWMutex
+	w       io.Writer
+	secrets []string
+}
+
+func (r *redactor) add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, s := range r.secrets {
+		seen[s] = true
+	}
+	for _, s := range secrets {
+		if len(s) >= minRedactedLength && !seen[s] {
+			seen[s] = true
+			r.secrets = append(r.secrets, s)
+		}
+	}
+	// longest first, so a secret containing another is redacted whole
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, "<redacted>")
+	}
+	return s
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactLogs sends every log line through logRedactor to stderr
+func redactLogs() {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	flags.Set("logtostderr", "false")
+	flags.Set("alsologtostderr", "false")
+	flags.Set("stderrthreshold", "FATAL")
+	flags.Set("one_output", "true")
+	klog.SetOutput(logRedactor)
+}
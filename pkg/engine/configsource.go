@@ -0,0 +1,509 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	configSourceCacheDir = "/opt/.cache/config-sources"
+	maxConfigSize        = 10 << 20
+)
+
+// ConfigSource is an additional config merged into the main config. Exactly one of Path, Url or Git is set.
+type ConfigSource struct {
+	// Path is a config file, or a directory whose .yaml and .yml files are read in lexical order,
+	// in the fetchit container
+	Path string `mapstructure:"path"`
+	// Url is a config file served over HTTP
+	Url string `mapstructure:"url"`
+	// Git is a repository holding configs at Path, the root of the repository by default
+	Git string `mapstructure:"git"`
+	// Branch of Git, main by default
+	Branch string `mapstructure:"branch"`
+	// Optional sources that cannot be read are skipped instead of failing the config
+	Optional bool `mapstructure:"optional"`
+}
+
+// configDocument is one config file and where it was read from
+type configDocument struct {
+	source string
+	values map[string]interface{}
+	// node is the parsed document, kept for the line numbers of validation errors
+	node *yaml.Node
+}
+
+// mergedConfig is the effective config and where each part of it came from
+type mergedConfig struct {
+	values map[string]interface{}
+	// sources lists every config read, in merge order
+	sources []string
+	// targetSources and imageSources are the source of each target and image, by index
+	targetSources []string
+	imageSources  []string
+	// keySources is the source of each top level key that is not a list
+	keySources map[string]string
+	// docs are the configs merged, and targetNodes, imageNodes and keyNodes locate each part in them
+	docs        []configDocument
+	targetNodes []*yaml.Node
+	imageNodes  []*yaml.Node
+	keyNodes    map[string]*yaml.Node
+	// resolved are the values with their references resolved, which the config is decoded from
+	resolved map[string]interface{}
+}
+
+// configListKeys are merged by appending, every other top level key may only be set by one source
+var configListKeys = map[string]string{
+	"targetconfigs": "targetConfigs",
+	"images":        "images",
+	"configsources": "configSources",
+}
+
+// loadConfig reads the config file at path and every config source it lists. A missing file is an
+// empty config.
+func loadConfig(path string) (*mergedConfig, error) {
+	var docs []configDocument
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	main, err := parseConfigDocument(b, "file "+path)
+	if err != nil {
+		return nil, err
+	}
+	docs = append(docs, main)
+
+	confd := filepath.Join(filepath.Dir(path), "conf.d")
+	if _, err := os.Stat(confd); err == nil {
+		dir, err := readConfigPath(confd, "dir "+confd)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, dir...)
+	}
+
+	var sources []*ConfigSource
+	if raw, ok := lookupKey(main.values, "configSources"); ok {
+		if err := mapstructure.Decode(raw, &sources); err != nil {
+			return nil, utils.WrapErr(err, "Error reading configSources in %s", main.source)
+		}
+	}
+	pat, _ := lookupKey(main.values, "pat")
+	patString, _ := pat.(string)
+	patString, secrets, err := resolveConfigString(patString, true)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading pat in %s", main.source)
+	}
+	logRedactor.add(secrets...)
+	for _, s := range sources {
+		for _, field := range []*string{&s.Path, &s.Url, &s.Git, &s.Branch} {
+			if *field, secrets, err = resolveConfigString(*field, false); err != nil {
+				return nil, utils.WrapErr(err, "Error reading configSources in %s", main.source)
+			}
+			logRedactor.add(secrets...)
+		}
+		read, err := s.read(patString)
+		if err != nil {
+			if s.Optional {
+				klog.Warningf("Skipping optional config source %s: %v", s, err)
+				continue
+			}
+			return nil, err
+		}
+		docs = append(docs, read...)
+	}
+	return mergeConfigDocuments(docs)
+}
+
+func (s *ConfigSource) String() string {
+	switch {
+	case s.Url != "":
+		return "url " + utils.StripUserinfo(s.Url)
+	case s.Git != "":
+		return fmt.Sprintf("git %s@%s:%s", utils.StripUserinfo(s.Git), s.branch(), s.Path)
+	default:
+		return "path " + s.Path
+	}
+}
+
+func (s *ConfigSource) branch() string {
+	if s.Branch == "" {
+		return "main"
+	}
+	return s.Branch
+}
+
+// read returns the configs of the source
+func (s *ConfigSource) read(pat string) ([]configDocument, error) {
+	set := 0
+	for _, v := range []string{s.Url, s.Git} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 || (set == 0 && s.Path == "") {
+		return nil, fmt.Errorf("config source must set one of path, url or git")
+	}
+	switch {
+	case s.Url != "":
+		b, err := httpGetLimited(s.Url, maxConfigSize)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error fetching config source %s", utils.StripUserinfo(s.Url))
+		}
+		doc, err := parseConfigDocument(b, s.String())
+		if err != nil {
+			return nil, err
+		}
+		return []configDocument{doc}, nil
+	case s.Git != "":
+		dir, err := fetchConfigRepository(s.Git, s.branch(), pat)
+		if err != nil {
+			return nil, err
+		}
+		p, err := utils.SafeJoin(dir, s.Path)
+		if err != nil {
+			return nil, err
+		}
+		return readConfigPath(p, s.String())
+	default:
+		return readConfigPath(s.Path, s.String())
+	}
+}
+
+// readConfigPath reads a config file, or the .yaml and .yml files of a directory in lexical order
+func readConfigPath(path, source string) ([]configDocument, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if !e.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+	var docs []configDocument
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		name := source
+		if fi.IsDir() {
+			name = source + "/" + filepath.Base(f)
+		}
+		doc, err := parseConfigDocument(b, name)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// fetchConfigRepository clones or updates a repository of configs in the cache and checks out branch
+func fetchConfigRepository(url, branch, pat string) (string, error) {
+	sum := sha256.Sum256([]byte(url + "@" + branch))
+	dir := filepath.Join(configSourceCacheDir, hex.EncodeToString(sum[:8]))
+	var user string
+	if pat != "" {
+		user = "fetchit"
+	}
+	auth := &githttp.BasicAuth{Username: user, Password: pat}
+	refName := plumbing.NewBranchReferenceName(branch)
+
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		_, err = git.PlainClone(dir, false, &git.CloneOptions{
+			Auth:          auth,
+			URL:           url,
+			ReferenceName: refName,
+			SingleBranch:  true,
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", utils.WrapErr(err, "Error cloning config repository %s", utils.StripUserinfo(url))
+		}
+		return dir, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", refName, refName))
+	if err := repo.Fetch(&git.FetchOptions{Auth: auth, RefSpecs: []config.RefSpec{refSpec}, Force: true}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", utils.WrapErr(err, "Error fetching config repository %s", utils.StripUserinfo(url))
+	}
+	ref, err := repo.Reference(refName, true)
+	if err != nil {
+		return "", err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: ref.Hash(), Force: true}); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func parseConfigDocument(b []byte, source string) (configDocument, error) {
+	doc := configDocument{source: source, values: make(map[string]interface{})}
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return doc, utils.WrapErr(err, "Error parsing config %s", source)
+	}
+	if len(node.Content) > 0 {
+		doc.node = node.Content[0]
+		if err := doc.node.Decode(&doc.values); err != nil {
+			return doc, utils.WrapErr(err, "Error parsing config %s", source)
+		}
+	}
+	if doc.values == nil {
+		doc.values = make(map[string]interface{})
+	}
+	return doc, nil
+}
+
+// lookupKey finds a top level key regardless of case, as the config loader matches keys
+func lookupKey(values map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range values {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// mergeConfigDocuments merges configs in order. Targets and images are appended and must be unique
+// across every config, targets by name, or by url or device and branch if they have no name, and
+// images by name. Any other setting may only be set by one config, and configSources only by the first.
+func mergeConfigDocuments(docs []configDocument) (*mergedConfig, error) {
+	m := &mergedConfig{
+		values:     make(map[string]interface{}),
+		keySources: make(map[string]string),
+		keyNodes:   make(map[string]*yaml.Node),
+		docs:       docs,
+	}
+	targets := make(map[string]string)
+	images := make(map[string]string)
+	var targetList, imageList []interface{}
+	for i, doc := range docs {
+		m.sources = append(m.sources, doc.source)
+		// sorted so errors do not depend on map order
+		var keys []string
+		for k := range doc.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := doc.values[k]
+			canonical, isList := configListKeys[strings.ToLower(k)]
+			if !isList {
+				lower := strings.ToLower(k)
+				if prev, ok := m.keySources[lower]; ok {
+					return nil, fmt.Errorf("%s is set in both %s and %s", k, prev, doc.source)
+				}
+				m.keySources[lower] = doc.source
+				m.keyNodes[lower] = nodeAt(doc.node, k)
+				m.values[k] = v
+				continue
+			}
+			items, ok := v.([]interface{})
+			if !ok && v != nil {
+				return nil, fmt.Errorf("%s in %s must be a list", k, doc.source)
+			}
+			list := nodeAt(doc.node, k)
+			switch canonical {
+			case "configSources":
+				if i != 0 {
+					return nil, fmt.Errorf("configSources may only be set in the main config, found in %s", doc.source)
+				}
+				m.values[canonical] = v
+				m.keySources["configsources"] = doc.source
+				m.keyNodes["configsources"] = list
+			case "targetConfigs":
+				for j, item := range items {
+					key, err := targetKey(item)
+					if err != nil {
+						return nil, utils.WrapErr(err, "Invalid target in %s", doc.source)
+					}
+					if prev, ok := targets[key]; ok {
+						return nil, fmt.Errorf("target %s is defined in both %s and %s", key, prev, doc.source)
+					}
+					targets[key] = doc.source
+					targetList = append(targetList, item)
+					m.targetSources = append(m.targetSources, doc.source)
+					m.targetNodes = append(m.targetNodes, nodeAt(list, j))
+				}
+			case "images":
+				for j, item := range items {
+					values, _ := item.(map[string]interface{})
+					// images without a name are kept apart, validate rejects them
+					if name, ok := lookupKey(values, "name"); ok && name != "" && name != nil {
+						key := fmt.Sprint(name)
+						if prev, ok := images[key]; ok {
+							return nil, fmt.Errorf("image %s is defined in both %s and %s", key, prev, doc.source)
+						}
+						images[key] = doc.source
+					}
+					imageList = append(imageList, item)
+					m.imageSources = append(m.imageSources, doc.source)
+					m.imageNodes = append(m.imageNodes, nodeAt(list, j))
+				}
+			}
+		}
+	}
+	if len(targetList) > 0 {
+		m.values["targetConfigs"] = targetList
+	}
+	if len(imageList) > 0 {
+		m.values["images"] = imageList
+	}
+	return m, nil
+}
+
+// targetKey identifies a target by its name, or by where it is fetched from if it has none
+func targetKey(item interface{}) (string, error) {
+	values, ok := item.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("target must be a map")
+	}
+	if name, ok := lookupKey(values, "name"); ok && name != "" && name != nil {
+		return fmt.Sprint(name), nil
+	}
+	location, ok := lookupKey(values, "url")
+	if !ok || location == "" {
+		location, _ = lookupKey(values, "device")
+	}
+	branch, _ := lookupKey(values, "branch")
+	return fmt.Sprintf("%v@%v", location, branch), nil
+}
+
+// decode returns the effective config, read the way viper reads a single config file, failing on
+// keys that match no field. References are decoded as written unless resolveRefs was called.
+func (m *mergedConfig) decode() (*FetchitConfig, error) {
+	values := m.values
+	if m.resolved != nil {
+		values = m.resolved
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.MergeConfigMap(values); err != nil {
+		return nil, err
+	}
+	config := newFetchitConfig()
+	if err := v.UnmarshalExact(&config); err != nil {
+		return nil, err
+	}
+	for i, tc := range config.TargetConfigs {
+		if i < len(m.targetSources) {
+			tc.source = m.targetSources[i]
+		}
+	}
+	return config, nil
+}
+
+// hash is the checksum of the effective config, used to detect a change in any source
+func (m *mergedConfig) hash() (string, error) {
+	b, err := yaml.Marshal(m.values)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// credentialKeys are the keys, in lower case, whose values view redacts wherever they are in the config
+var credentialKeys = map[string]bool{"pat": true, "username": true, "password": true}
+
+// redactCredentials replaces the value of every credential key below node, unless it is a reference
+// to where the credential is read from
+func redactCredentials(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if !credentialKeys[strings.ToLower(key.Value)] {
+				redactCredentials(value)
+				continue
+			}
+			if value.Kind != yaml.ScalarNode || !isConfigRef(value.Value) {
+				value.Kind, value.Tag, value.Style, value.Value, value.Content = yaml.ScalarNode, "!!str", 0, "<redacted>", nil
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			redactCredentials(item)
+		}
+	}
+}
+
+// view writes the effective config as yaml, with the source of every target and image as a comment
+func (m *mergedConfig) view(w io.Writer) error {
+	var doc yaml.Node
+	if err := doc.Encode(m.values); err != nil {
+		return err
+	}
+	mapping := &doc
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		mapping = doc.Content[0]
+	}
+	header := []string{"merged from, in order:"}
+	for _, s := range m.sources {
+		header = append(header, "- "+s)
+	}
+	header = append(header, "")
+	doc.HeadComment = strings.Join(header, "\n")
+	redactCredentials(mapping)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		var sources []string
+		switch strings.ToLower(key.Value) {
+		case "targetconfigs":
+			sources = m.targetSources
+		case "images":
+			sources = m.imageSources
+		default:
+			key.HeadComment = "source: " + m.keySources[strings.ToLower(key.Value)]
+			continue
+		}
+		for j, item := range value.Content {
+			if j < len(sources) {
+				item.HeadComment = "source: " + sources[j]
+			}
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -2,6 +2,9 @@ package engine
 
 import (
 	"context"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/containers/podman/v4/libpod/define"
 	"github.com/containers/podman/v4/pkg/bindings/containers"
@@ -13,7 +16,48 @@ import (
 
 const stopped = define.ContainerStateStopped
 
-func generateSpec(method, file, copyFile, dest string, name string) *specgen.SpecGenerator {
+// placeFileScript refuses $DEST if a directory between it and $ROOT is a symlink, which could
+// lead outside of $ROOT. It creates the missing directories above $DEST with $DIR_MODE and $CHOWN,
+// copies $SRC next to $DEST under a temporary name, applies ownership, mode and SELinux label,
+// verifies the copy against $SHA256 and renames it into place so that consumers never see a
+// partially written file
+const placeFileScript = `set -e
+dir=$(dirname "$DEST")
+d="$dir"
+while [ -n "$ROOT" ] && [ "$d" != "$ROOT" ] && [ "$d" != "/" ]; do
+  if [ -L "$d" ]; then
+    echo "$d is a symlink, refusing to place $DEST" >&2
+    exit 1
+  fi
+  d=$(dirname "$d")
+done
+d="$dir"
+set --
+while [ ! -d "$d" ]; do
+  set -- "$d" "$@"
+  d=$(dirname "$d")
+done
+for d in "$@"; do
+  mkdir "$d"
+  if [ -n "$DIR_MODE" ]; then chmod "$DIR_MODE" "$d"; fi
+  if [ -n "$CHOWN" ]; then chown "$CHOWN" "$d"; fi
+done
+tmp="$dir/.$(basename "$DEST").fetchit-tmp"
+trap 'rm -f "$tmp"' EXIT
+cp -p "$SRC" "$tmp"
+if [ -n "$CHOWN" ]; then chown "$CHOWN" "$tmp"; fi
+if [ -n "$MODE" ]; then chmod "$MODE" "$tmp"; fi
+if [ -n "$SELINUX_CONTEXT" ]; then chcon "$SELINUX_CONTEXT" "$tmp"; fi
+sum=$(sha256sum "$tmp" | cut -d ' ' -f 1)
+if [ "$sum" != "$SHA256" ]; then
+  echo "checksum mismatch for $DEST: expected $SHA256, got $sum" >&2
+  exit 1
+fi
+mv -f "$tmp" "$DEST"
+trap - EXIT
+`
+
+func generateSpec(method, file, dest string, name string, env map[string]string) *specgen.SpecGenerator {
 	s := specgen.NewSpecGenerator(fetchitImage, false)
 	s.Name = method + "-" + name + "-" + file
 	s.Privileged = true
@@ -21,50 +65,88 @@ func generateSpec(method, file, copyFile, dest string, name string) *specgen.Spe
 		NSMode: "host",
 		Value:  "",
 	}
-	s.Command = []string{"sh", "-c", "cp -rp" + " " + copyFile}
+	s.Command = []string{"sh", "-c", placeFileScript}
+	s.Env = env
 	s.Mounts = []specs.Mount{{Source: dest, Destination: dest, Type: "bind", Options: []string{"rw"}}}
 	s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"rw"}}}
 	return s
 }
 
-func generateDeviceSpec(method, file, copyFile, device string, name string) *specgen.SpecGenerator {
-	s := specgen.NewSpecGenerator(fetchitImage, false)
-	s.Name = method + "-" + name + "-" + file
-	s.Privileged = true
-	s.PidNS = specgen.Namespace{
-		NSMode: "host",
-		Value:  "",
-	}
-	s.Command = []string{"sh", "-c", "mount" + " " + device + " " + "/mnt/ ; cp -rp" + " " + copyFile}
-	s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"rw"}}}
-	s.Devices = []specs.LinuxDevice{{Path: device}}
-	return s
+// removeFilesScript removes each path in $REMOVE, one per line, along with any
+// parent directories below $DEST that are left empty. Paths below a symlinked
+// directory are refused. It exits non-zero if a path could not be removed.
+const removeFilesScript = `printf '%s\n' "$REMOVE" | {
+  rc=0
+  while IFS= read -r f; do
+    [ -n "$f" ] || continue
+    dir=$(dirname "$f")
+    while [ "$dir" != "$DEST" ] && [ "$dir" != "/" ] && [ ! -L "$dir" ]; do
+      dir=$(dirname "$dir")
+    done
+    if [ -L "$dir" ]; then
+      echo "$dir is a symlink, refusing to remove $f" >&2
+      rc=1
+      continue
+    fi
+    if ! rm -f -- "$f"; then
+      rc=1
+      continue
+    fi
+    dir=$(dirname "$f")
+    while [ "$dir" != "$DEST" ] && [ "$dir" != "/" ] && rmdir "$dir" 2>/dev/null; do
+      dir=$(dirname "$dir")
+    done
+  done
+  exit $rc
 }
+`
+
+// listFilesScript prints every file below $DEST as F:<path> and every directory as D:<path>
+const listFilesScript = `walk() {
+  for f in "$1"/* "$1"/.[!.]* "$1"/..?*; do
+    [ -e "$f" ] || [ -L "$f" ] || continue
+    if [ -d "$f" ] && [ ! -L "$f" ]; then
+      echo "D:$f"
+      walk "$f"
+    else
+      echo "F:$f"
+    fi
+  done
+}
+walk "$DEST"
+`
 
-func generateDevicePresentSpec(method, file, device string, name string) *specgen.SpecGenerator {
+func generateSpecRemove(method, file string, pathsToRemove []string, dest, name string) *specgen.SpecGenerator {
 	s := specgen.NewSpecGenerator(fetchitImage, false)
-	s.Name = method + "-" + name + "-" + file + "-" + "device-check"
+	s.Name = method + "-" + name + "-" + file
 	s.Privileged = true
 	s.PidNS = specgen.Namespace{
 		NSMode: "host",
 		Value:  "",
 	}
-	s.Command = []string{"sh", "-c", "if [ ! -b " + device + " ]; then exit 1; fi"}
-	s.Devices = []specs.LinuxDevice{{Path: device}}
+	s.Command = []string{"sh", "-c", removeFilesScript}
+	s.Env = map[string]string{
+		"DEST":   filepath.Clean(dest),
+		"REMOVE": strings.Join(pathsToRemove, "\n"),
+	}
+	s.Mounts = []specs.Mount{{Source: dest, Destination: dest, Type: "bind", Options: []string{"rw"}}}
+	s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"ro"}}}
 	return s
 }
 
-func generateSpecRemove(method, file, pathToRemove, dest, name string) *specgen.SpecGenerator {
+func generateSpecList(method, dest, name string) *specgen.SpecGenerator {
 	s := specgen.NewSpecGenerator(fetchitImage, false)
-	s.Name = method + "-" + name + "-" + file
+	s.Name = method + "-" + name + "-list"
 	s.Privileged = true
 	s.PidNS = specgen.Namespace{
 		NSMode: "host",
 		Value:  "",
 	}
-	s.Command = []string{"sh", "-c", "rm " + pathToRemove}
-	s.Mounts = []specs.Mount{{Source: dest, Destination: dest, Type: "bind", Options: []string{"rw"}}}
-	s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"ro"}}}
+	s.Command = []string{"sh", "-c", listFilesScript}
+	s.Env = map[string]string{
+		"DEST": filepath.Clean(dest),
+	}
+	s.Mounts = []specs.Mount{{Source: dest, Destination: dest, Type: "bind", Options: []string{"ro"}}}
 	return s
 }
 
@@ -81,22 +163,51 @@ func createAndStartContainer(conn context.Context, s *specgen.SpecGenerator) (en
 	return createResponse, nil
 }
 
-func waitAndRemoveContainer(conn context.Context, ID string) error {
-	_, err := containers.Wait(conn, ID, new(containers.WaitOptions).WithCondition([]define.ContainerStatus{stopped}))
+// waitCollectAndRemoveContainer waits for the container to exit, gathers
+// everything it wrote to stdout and stderr, and removes it.
+func waitCollectAndRemoveContainer(conn context.Context, ID string) (int32, string, error) {
+	exitCode, err := containers.Wait(conn, ID, new(containers.WaitOptions).WithCondition([]define.ContainerStatus{stopped}))
 	if err != nil {
-		return err
+		return exitCode, "", err
 	}
 
-	_, err = containers.Remove(conn, ID, new(containers.RemoveOptions).WithForce(true))
-	if err != nil {
+	var output strings.Builder
+	var wg sync.WaitGroup
+	stdout := make(chan string)
+	stderr := make(chan string)
+	wg.Add(1)
+	go func(outCh, errCh chan string) {
+		defer wg.Done()
+		for outCh != nil || errCh != nil {
+			select {
+			case line, ok := <-outCh:
+				if !ok {
+					outCh = nil
+					continue
+				}
+				output.WriteString(line)
+			case line, ok := <-errCh:
+				if !ok {
+					errCh = nil
+					continue
+				}
+				output.WriteString(line)
+			}
+		}
+	}(stdout, stderr)
+	logErr := containers.Logs(conn, ID, new(containers.LogOptions).WithStdout(true).WithStderr(true), stdout, stderr)
+	close(stdout)
+	close(stderr)
+	wg.Wait()
+
+	if _, err := containers.Remove(conn, ID, new(containers.RemoveOptions).WithForce(true)); err != nil {
 		// There's a podman bug somewhere that's causing this
-		if err.Error() == "unexpected end of JSON input" {
-			return nil
+		if err.Error() != "unexpected end of JSON input" {
+			return exitCode, output.String(), err
 		}
-		return err
 	}
 
-	return nil
+	return exitCode, output.String(), logErr
 }
 
 func detectOrFetchImage(conn context.Context, imageName string, force bool) error {
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runScript runs a placement script with sh and the given environment
+func runScript(t *testing.T, script string, env map[string]string) (string, error) {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestPlaceFileScript(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("content"), 0600); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	sum, err := fileSHA256(src)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	destFile := filepath.Join(dest, "a", "b", "c", "file")
+	if out, err := runScript(t, placeFileScript, map[string]string{"SRC": src, "DEST": destFile, "SHA256": sum, "DIR_MODE": "0750"}); err != nil {
+		t.Fatalf("Failed: %v: %s", err, out)
+	}
+	if b, err := os.ReadFile(destFile); err != nil || string(b) != "content" {
+		t.Fatalf("Failed: unexpected content %q: %v", b, err)
+	}
+	for _, d := range []string{"a", "a/b", "a/b/c"} {
+		fi, err := os.Stat(filepath.Join(dest, d))
+		if err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		if fi.Mode().Perm() != 0750 {
+			t.Errorf("Failed: %s has mode %o, expected 750", d, fi.Mode().Perm())
+		}
+	}
+	if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("Failed: existing destination directory was changed: %v", err)
+	}
+
+	// a symlinked directory below the destination could lead anywhere on the host
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	linked := filepath.Join(dest, "link", "sub", "file")
+	if out, err := runScript(t, placeFileScript, map[string]string{"SRC": src, "ROOT": dest, "DEST": linked, "SHA256": sum}); err == nil || !strings.Contains(out, "is a symlink") {
+		t.Fatalf("Failed: expected symlink to be refused, got %v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "sub")); !os.IsNotExist(err) {
+		t.Fatalf("Failed: a directory was created through the symlink: %v", err)
+	}
+
+	out, err := runScript(t, placeFileScript, map[string]string{"SRC": src, "DEST": destFile, "SHA256": "0000"})
+	if err == nil || !strings.Contains(out, "checksum mismatch") {
+		t.Fatalf("Failed: expected checksum mismatch, got %v: %s", err, out)
+	}
+}
+
+func TestRemoveFilesScript(t *testing.T) {
+	dest := t.TempDir()
+	file := filepath.Join(dest, "a", "b", "file")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if out, err := runScript(t, removeFilesScript, map[string]string{"DEST": dest, "REMOVE": file + "\n" + filepath.Join(dest, "missing")}); err != nil {
+		t.Fatalf("Failed: %v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a")); !os.IsNotExist(err) {
+		t.Fatalf("Failed: expected empty parent directories to be removed: %v", err)
+	}
+
+	// files below a symlinked directory are not removed
+	outside := t.TempDir()
+	kept := filepath.Join(outside, "kept")
+	if err := os.WriteFile(kept, nil, 0600); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if _, err := runScript(t, removeFilesScript, map[string]string{"DEST": dest, "REMOVE": filepath.Join(dest, "link", "kept")}); err == nil {
+		t.Fatalf("Failed: expected removal through a symlink to be refused")
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatalf("Failed: file was removed through a symlink: %v", err)
+	}
+
+	// a directory cannot be removed as a file
+	busy := filepath.Join(dest, "busy")
+	if err := os.MkdirAll(filepath.Join(busy, "child"), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if _, err := runScript(t, removeFilesScript, map[string]string{"DEST": dest, "REMOVE": busy}); err == nil {
+		t.Fatalf("Failed: expected failure removing %s", busy)
+	}
+}
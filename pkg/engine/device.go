@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// devRoot is where device nodes and the udev /dev/disk links are found
+var devRoot = "/dev"
+
+// preferredFilesystems are tried first, in order, when mounting a device
+var preferredFilesystems = []string{"vfat", "exfat", "ext4", "xfs", "btrfs", "ntfs3", "iso9660", "udf"}
+
+var errDeviceNotPresent = errors.New("device not present")
+
+// resolveDevice finds the block device for spec, which is a path such as /dev/sdb1 or one of
+// LABEL=, UUID=, PARTLABEL= or PARTUUID=, looked up through the links udev keeps in /dev/disk
+func resolveDevice(spec string) (string, error) {
+	path := spec
+	if kv := strings.SplitN(spec, "=", 2); len(kv) == 2 {
+		dir := map[string]string{
+			"LABEL":     "by-label",
+			"UUID":      "by-uuid",
+			"PARTLABEL": "by-partlabel",
+			"PARTUUID":  "by-partuuid",
+		}[strings.ToUpper(kv[0])]
+		if dir == "" {
+			return "", fmt.Errorf("unknown device identifier %s", kv[0])
+		}
+		value := kv[1]
+		if dir == "by-uuid" || dir == "by-partuuid" {
+			value = strings.ToLower(value)
+		}
+		path = filepath.Join(devRoot, "disk", dir, udevEncode(value))
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errDeviceNotPresent
+		}
+		return "", err
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("%s is not a block device", resolved)
+	}
+	return resolved, nil
+}
+
+// udevEncode escapes a label the way udev does for the names of /dev/disk links
+func udevEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || strings.IndexByte("#+-.:=@_", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// deviceFilesystems returns the block filesystems the kernel supports, preferred ones first
+func deviceFilesystems() []string {
+	supported := make(map[string]bool)
+	var others []string
+	if f, err := os.Open("/proc/filesystems"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// virtual filesystems are marked nodev
+			if len(fields) == 1 {
+				supported[fields[0]] = true
+				others = append(others, fields[0])
+			}
+		}
+		f.Close()
+	}
+	var types []string
+	tried := make(map[string]bool)
+	for _, t := range preferredFilesystems {
+		// exfat and ntfs3 may be modules that are not loaded yet
+		if supported[t] || len(supported) == 0 || t == "exfat" || t == "ntfs3" {
+			types = append(types, t)
+			tried[t] = true
+		}
+	}
+	for _, t := range others {
+		if !tried[t] {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// withDevice mounts the device read-only, runs fn with the mount point and unmounts it again,
+// returning false without calling fn if the device is not present
+func withDevice(spec string, fn func(mountPoint string) error) (bool, error) {
+	device, err := resolveDevice(spec)
+	if err == errDeviceNotPresent {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	mountPoint, err := os.MkdirTemp("", "fetchit-device-")
+	if err != nil {
+		return true, err
+	}
+	defer os.Remove(mountPoint)
+
+	if err := mountDevice(device, mountPoint); err != nil {
+		return true, err
+	}
+	defer unmountDevice(mountPoint)
+	return true, fn(mountPoint)
+}
+
+func mountDevice(device, mountPoint string) error {
+	flags := uintptr(unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	var errs []string
+	for _, fsType := range deviceFilesystems() {
+		err := unix.Mount(device, mountPoint, fsType, flags, "")
+		if err == nil {
+			klog.Infof("Mounted %s (%s) read-only at %s", device, fsType, mountPoint)
+			return nil
+		}
+		if err == unix.EPERM || err == unix.EACCES {
+			return utils.WrapErr(err, "Error mounting %s, fetchit must run privileged to mount devices", device)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", fsType, err))
+	}
+	return fmt.Errorf("unable to mount %s: %s", device, strings.Join(errs, ", "))
+}
+
+// unmountDevice retries a busy unmount before detaching the mount lazily
+func unmountDevice(mountPoint string) {
+	for i := 0; i < 5; i++ {
+		err := unix.Unmount(mountPoint, 0)
+		if err == nil || err == unix.EINVAL {
+			return
+		}
+		if err != unix.EBUSY {
+			klog.Warningf("Error unmounting %s: %v", mountPoint, err)
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err := unix.Unmount(mountPoint, unix.MNT_DETACH); err != nil {
+		klog.Errorf("Error detaching %s: %v", mountPoint, err)
+	}
+}
+
+// copyFromDevice copies src, a file or directory, to dest, verifying each file against its
+// source once written. Symlinks are copied as long as they resolve within src.
+func copyFromDevice(src, dest string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return copyVerified(src, dest, fi.Mode().Perm())
+	}
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			// resolved through the other symlinks on the device, which may lead elsewhere than the link reads
+			resolved, err := utils.ResolveWithin(src, filepath.Dir(p), link)
+			if err != nil || !utils.IsWithin(src, resolved) {
+				return fmt.Errorf("symlink %s -> %s escapes %s", p, link, src)
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			return copyVerified(p, target, fi.Mode().Perm())
+		default:
+			klog.Warningf("Skipping %s, not a regular file", p)
+			return nil
+		}
+	})
+}
+
+// copyVerified copies src to dest through a temporary file, which is read back and
+// compared with the checksum of what was read from src before it replaces dest
+func copyVerified(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dest + ".fetchit-tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return utils.WrapErr(err, "Error copying %s", src)
+	}
+	written, err := fileSHA256(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if read := hex.EncodeToString(h.Sum(nil)); read != written {
+		os.Remove(tmp)
+		return fmt.Errorf("verification of %s failed, copied %s but read %s", src, written, read)
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveDevice(t *testing.T) {
+	if udevEncode("FETCHIT USB/1") != `FETCHIT\x20USB\x2f1` {
+		t.Fatalf("Failed: unexpected encoding %s", udevEncode("FETCHIT USB/1"))
+	}
+
+	root := t.TempDir()
+	defer func(prev string) { devRoot = prev }(devRoot)
+	devRoot = root
+	if _, err := resolveDevice("LABEL=FETCHIT"); err != errDeviceNotPresent {
+		t.Fatalf("Failed: expected device not present, got %v", err)
+	}
+
+	// a regular file behind a label link is not a block device
+	if err := os.MkdirAll(filepath.Join(root, "disk", "by-label"), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sdb1"), nil, 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink("../../sdb1", filepath.Join(root, "disk", "by-label", "FETCHIT")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if _, err := resolveDevice("LABEL=FETCHIT"); err == nil || err == errDeviceNotPresent {
+		t.Fatalf("Failed: expected error for a file that is not a block device, got %v", err)
+	}
+	if _, err := resolveDevice("SERIAL=1234"); err == nil {
+		t.Fatalf("Failed: expected error for unknown identifier")
+	}
+}
+
+func TestCopyFromDevice(t *testing.T) {
+	src := t.TempDir()
+	dest := filepath.Join(t.TempDir(), "fetchit")
+	if err := os.MkdirAll(filepath.Join(src, ".git", "refs"), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink(".git/HEAD", filepath.Join(src, "HEAD")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := copyFromDevice(src, dest); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dest, "HEAD"))
+	if err != nil || string(b) != "ref: refs/heads/main\n" {
+		t.Fatalf("Failed: unexpected copy %q, %v", b, err)
+	}
+
+	if err := os.Symlink("../../etc/passwd", filepath.Join(src, "passwd")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := copyFromDevice(src, dest); err == nil {
+		t.Fatalf("Failed: expected error for a symlink escaping the device")
+	}
+
+	// x/y/a reads as staying within the device, but l1 is the root of the device
+	chained := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(chained, "x", "y"), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink("../..", filepath.Join(chained, "x", "y", "l1")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink("l1/../../..", filepath.Join(chained, "x", "y", "a")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := copyFromDevice(chained, filepath.Join(t.TempDir(), "fetchit")); err == nil {
+		t.Fatalf("Failed: expected error for a symlink escaping the device through another symlink")
+	}
+}
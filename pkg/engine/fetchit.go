@@ -3,7 +3,6 @@ package engine
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"os"
 	"path/filepath"
 	"time"
@@ -14,7 +13,6 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	"k8s.io/klog/v2"
 )
@@ -43,12 +41,18 @@ type Fetchit struct {
 	scheduler          *gocron.Scheduler
 	methodTargetScheds map[Method]SchedInfo
 	allMethodTypes     map[string]struct{}
+	// targets are the targets with a repository by id, kept across reloads
+	targets map[string]*Target
+	// scheduled are the methods in the scheduler by key
+	scheduled map[string]*scheduledMethod
 }
 
 func newFetchit() *Fetchit {
 	return &Fetchit{
 		methodTargetScheds: make(map[Method]SchedInfo),
 		allMethodTypes:     make(map[string]struct{}),
+		targets:            make(map[string]*Target),
+		scheduled:          make(map[string]*scheduledMethod),
 	}
 }
 
@@ -72,40 +76,62 @@ var fetchitCmd = &cobra.Command{
 // Execute adds all child commands to the root command and sets flags
 // appropriately. This is called by main.main().
 func Execute() {
+	redactLogs()
 	cobra.CheckErr(fetchitCmd.Execute())
 }
 
-// restart fetches new targets from an updated config
-// new targets will be added, stale removed, and existing
-// will set last commit as last known.
-func (fc *FetchitConfig) Restart() {
-	for mt := range fetchit.allMethodTypes {
-		fetchit.scheduler.RemoveByTags(mt)
+// Restart reloads the config from defaultConfigPath and reschedules only the methods that changed.
+// If the new config cannot be loaded, the current config keeps running and the error is returned.
+func (fc *FetchitConfig) Restart() error {
+	config, _, err := populateConfig()
+	if err != nil {
+		return err
 	}
-	fetchit.scheduler.Clear()
-	fetchit = fc.InitConfig(false)
-	fetchit.RunTargets()
+	previous := fetchit
+	next := fc.populateFetchit(config)
+	for id, target := range next.targets {
+		if target.url != "" && previous.targets[id] != target {
+			if err := getRepo(target, next.pat); err != nil {
+				klog.Warningf("Target: %s, clone error: %v, will retry next scheduled run", target.url, err)
+			}
+		}
+	}
+	next.reschedule(previous)
+	return nil
 }
 
-func populateConfig(v *viper.Viper) (*FetchitConfig, bool, error) {
-	config := newFetchitConfig()
-	configDir := filepath.Dir(defaultConfigPath)
-	configName := filepath.Base(defaultConfigPath)
-	v.AddConfigPath(configDir)
-	v.SetConfigName(configName)
-	v.SetConfigType("yaml")
-
-	if err := v.ReadInConfig(); err == nil {
-		if err := v.Unmarshal(&config); err != nil {
-			klog.Info("Error with unmarshal of existing config file: %v", err)
-			return nil, false, err
+// populateConfig reads the config at defaultConfigPath merged with its config sources
+func populateConfig() (*FetchitConfig, bool, error) {
+	merged, err := loadConfig(defaultConfigPath)
+	if err != nil {
+		klog.Errorf("Error loading config: %v", err)
+		return nil, false, err
+	}
+	if err := merged.resolveRefs(); err != nil {
+		klog.Errorf("Error resolving config references:\n%v", err)
+		return nil, false, err
+	}
+	config, err := merged.validate()
+	if err != nil {
+		klog.Errorf("Invalid config:\n%v", err)
+		return nil, false, err
+	}
+	if config.configHash, err = merged.hash(); err != nil {
+		return nil, false, err
+	}
+	config.hasSources = len(merged.sources) > 1
+	if config.hasSources {
+		for _, tc := range config.TargetConfigs {
+			klog.Infof("Target %s from %s", tc.Name, tc.source)
 		}
 	}
 	return config, true, nil
 }
 
 func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
+	previous := fetchit
 	fetchit = newFetchit()
+	fc.PAT = config.PAT
 	fetchit.pat = fc.PAT
 	ctx := context.Background()
 	if fc.conn == nil {
@@ -124,10 +150,11 @@ func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
 		cobra.CheckErr(err)
 	}
 
-	// look for a ConfigURL, only find the first
-	// TODO: add logic to merge multiple configs
+	fc.configHash = config.configHash
+	fc.hasSources = config.hasSources
+	// configReload also reloads the config when any of its sources change
 	if config.ConfigReload != nil {
-		if config.ConfigReload.ConfigURL != "" || config.ConfigReload.Device != "" {
+		if config.ConfigReload.ConfigURL != "" || config.ConfigReload.Device != "" || config.ConfigReload.Git != nil || config.hasSources {
 			// reset URL if necessary
 			// ConfigURL set in config file overrides env variable
 			// If the same, this is no change, if diff then the new config has updated the configURL
@@ -166,22 +193,21 @@ func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
 		fc.scheduler = gocron.NewScheduler(time.UTC)
 	}
 	fetchit.scheduler = fc.scheduler
-	return getMethodTargetScheds(fc.TargetConfigs, fetchit)
+	return getMethodTargetScheds(fc.TargetConfigs, fetchit, previous)
 }
 
 // This location will be checked first. This is from a `-v /path/to/config.yaml:/opt/mount/config.yaml`,
 // If not initial, this may be overwritten with what is currently in FETCHIT_CONFIG_URL
-func isLocalConfig(v *viper.Viper) (*FetchitConfig, bool, error) {
+func isLocalConfig() (*FetchitConfig, bool, error) {
 	if _, err := os.Stat(defaultConfigPath); err != nil {
 		klog.Infof("Local config file not found: %v", err)
 		return nil, false, err
 	}
-	return populateConfig(v)
+	return populateConfig()
 }
 
 // Initconfig reads in config file and env variables if set.
 func (fc *FetchitConfig) InitConfig(initial bool) *Fetchit {
-	v := viper.New()
 	var err error
 	var isLocal, exists bool
 	var config *FetchitConfig
@@ -198,7 +224,7 @@ func (fc *FetchitConfig) InitConfig(initial bool) *Fetchit {
 		}
 	}
 
-	config, isLocal, err = isLocalConfig(v)
+	config, isLocal, err = isLocalConfig()
 	if (initial && !isLocal) || err != nil {
 		// Only run this from initial startup and only after trying to populate the config from a local file.
 		// because CheckForConfigUpdates also runs with each processConfig, so if !initial this is already done
@@ -211,7 +237,10 @@ func (fc *FetchitConfig) InitConfig(initial bool) *Fetchit {
 	if !isLocal {
 		// If not initial run, only way to get here is if already determined need for reload
 		// with an updated config placed in defaultConfigPath.
-		config, exists, err = populateConfig(v)
+		config, exists, err = populateConfig()
+		if err != nil && rejectConfig(err) {
+			config, exists, err = populateConfig()
+		}
 		if config == nil || !exists || err != nil {
 			if err != nil {
 				cobra.CheckErr(fmt.Errorf("Could not populate config, tried %s in fetchit pod and also URL: %s. Ensure local config is mounted or served from a URL and try again.", defaultConfigPath, envURL))
@@ -227,16 +256,22 @@ func (fc *FetchitConfig) InitConfig(initial bool) *Fetchit {
 	return fc.populateFetchit(config)
 }
 
-func getMethodTargetScheds(targetConfigs []*TargetConfig, fetchit *Fetchit) *Fetchit {
+// getMethodTargetScheds builds the methods of every target, reusing the unchanged targets of the
+// previous config, if any
+func getMethodTargetScheds(targetConfigs []*TargetConfig, fetchit *Fetchit, previous *Fetchit) *Fetchit {
 	for _, tc := range targetConfigs {
 		tc.mu.Lock()
 		defer tc.mu.Unlock()
 		internalTarget := &Target{
+			name:         tc.Name,
 			url:          tc.Url,
 			device:       tc.Device,
 			branch:       tc.Branch,
 			disconnected: tc.Disconnected,
+			bundle:       tc.Bundle,
+			vars:         tc.Vars,
 		}
+		internalTarget = fetchit.reuseTarget(internalTarget, previous)
 
 		if tc.configReload != nil {
 			tc.configReload.target = internalTarget
@@ -314,20 +349,12 @@ func (f *Fetchit) RunTargets() {
 		}
 	}
 
-	s := f.scheduler
 	for method, schedInfo := range f.methodTargetScheds {
-		skew := 0
-		if schedInfo.skew != nil {
-			skew = rand.Intn(*schedInfo.skew)
+		if err := f.schedule(method, schedInfo); err != nil {
+			klog.Errorf("Error scheduling %s: %v", methodKey(method), err)
 		}
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		mt := method.GetKind()
-		klog.Infof("Processing git target: %s Method: %s Name: %s", method.GetTarget().url, mt, method.GetName())
-		s.Cron(schedInfo.schedule).Tag(mt).Do(method.Process, ctx, f.conn, f.pat, skew)
-		s.StartImmediately()
-	}
-	s.StartAsync()
+	}
+	f.scheduler.StartAsync()
 	select {}
 }
 
@@ -335,9 +362,9 @@ func getRepo(target *Target, PAT string) error {
 	if target.url != "" && !target.disconnected {
 		getClone(target, PAT)
 	} else if target.disconnected && len(target.url) > 0 {
-		getDisconnected(target)
+		return getDisconnected(target)
 	} else if target.disconnected && len(target.device) > 0 {
-		getDeviceDisconnected(target)
+		return getDeviceDisconnected(target)
 	}
 	return nil
 }
@@ -361,15 +388,8 @@ func getClone(target *Target, PAT string) error {
 
 	if !exists {
 		klog.Infof("git clone %s %s --recursive", target.url, target.branch)
-		var user string
-		if PAT != "" {
-			user = "fetchit"
-		}
 		_, err = git.PlainClone(absPath, false, &git.CloneOptions{
-			Auth: &githttp.BasicAuth{
-				Username: user, // the value of this field should not matter when using a PAT
-				Password: PAT,
-			},
+			Auth:          target.gitAuth(PAT),
 			URL:           target.url,
 			ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", target.branch)),
 			SingleBranch:  true,
@@ -381,6 +401,21 @@ func getClone(target *Target, PAT string) error {
 	return nil
 }
 
+// gitAuth returns the credentials to clone the target with, its own or the PAT
+func (target *Target) gitAuth(PAT string) *githttp.BasicAuth {
+	if target.password != "" {
+		return &githttp.BasicAuth{Username: target.username, Password: target.password}
+	}
+	var user string
+	if PAT != "" {
+		user = "fetchit" // the value of this field should not matter when using a PAT
+	}
+	return &githttp.BasicAuth{
+		Username: user,
+		Password: PAT,
+	}
+}
+
 func getDisconnected(target *Target) error {
 	directory := getDirectory(target)
 	var exists bool
@@ -394,7 +429,10 @@ func getDisconnected(target *Target) error {
 		return err
 	}
 	if !exists {
-		extractZip(target.url)
+		if err := fetchBundle(target); err != nil {
+			klog.Errorf("Failed to fetch bundle %s: %v", target.url, err)
+			return err
+		}
 	}
 	return nil
 }
@@ -412,7 +450,10 @@ func getDeviceDisconnected(target *Target) error {
 		return err
 	}
 	if !exists {
-		localDevicePull(directory, target.device, "", false)
+		if err := fetchDeviceRepository(target); err != nil {
+			klog.Errorf("Failed to fetch %s from device %s: %v", directory, target.device, err)
+			return err
+		}
 	}
 	return nil
 }
@@ -2,11 +2,21 @@ package engine
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/containers/fetchit/pkg/engine/utils"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/gobwas/glob"
 	"k8s.io/klog/v2"
 )
 
@@ -17,6 +27,42 @@ type FileTransfer struct {
 	CommonMethod `mapstructure:",squash"`
 	// Directory path on the host system in which the target files should be placed
 	DestinationDirectory string `mapstructure:"destinationDirectory"`
+	// Owner of placed files and created directories, a user name or UID on the host
+	Owner string `mapstructure:"owner"`
+	// Group of placed files and created directories, a group name or GID on the host
+	Group string `mapstructure:"group"`
+	// Mode of placed files in octal, e.g. "0644"
+	Mode string `mapstructure:"mode"`
+	// Mode of directories created under the destination directory in octal, e.g. "0755"
+	DirMode string `mapstructure:"dirMode"`
+	// SELinux context to label placed files with, e.g. "system_u:object_r:container_file_t:s0"
+	SELinuxContext string `mapstructure:"seLinuxContext"`
+	// If true, the destination directory mirrors the target path, including nested
+	// directories, and files that are not in git are removed from it
+	Sync bool `mapstructure:"sync"`
+	// Glob patterns, relative to the destination directory, of files that Sync leaves alone
+	Ignore []string `mapstructure:"ignore"`
+	// If true, files are rendered with Go text/template before placement, see TemplateData
+	// Rendered files are only placed when their content changed
+	Template bool `mapstructure:"template"`
+	// Vars are available to templates as .Vars, overriding the target's vars
+	Vars map[string]interface{} `mapstructure:"vars"`
+	// Files in the fetchit container, such as mounted podman secrets, available to templates
+	// as .Secrets keyed by file name
+	SecretFiles []string `mapstructure:"secretFiles"`
+	// Hooks run after files whose content changed are placed or removed
+	OnChange []*Hook `mapstructure:"onChange"`
+	// chown is the numeric owner and group resolved from Owner and Group
+	chown *string
+	// templateData is gathered once for each run
+	templateData *TemplateData
+	// placed holds the sha256 of each file last placed, keyed by destination path
+	placed map[string]string
+	// changed holds the files, relative to the destination directory, changed by this run
+	changed []string
+	// pendingHooks holds the number of changed files for each hook that has yet to succeed
+	pendingHooks map[int]int
+	hookResults  []HookResult
 }
 
 func (ft *FileTransfer) GetKind() string {
@@ -48,69 +94,528 @@ func (ft *FileTransfer) Process(ctx, conn context.Context, PAT string, skew int)
 		}
 	}
 
-	err := currentToLatest(ctx, conn, ft, target, nil)
+	err := currentToLatest(ctx, conn, ft, target, PAT, nil)
 	if err != nil {
 		klog.Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
+	if ft.Template {
+		// host facts, vars and secrets may change without a new commit
+		if err := ft.refreshTemplates(ctx, conn); err != nil {
+			klog.Errorf("Error refreshing templates: %v", err)
+			return
+		}
+	} else if len(ft.pendingHooks) > 0 {
+		// retry hooks that failed on a previous run
+		if err := ft.runHooks(conn); err != nil {
+			klog.Errorf("Error running onChange hooks: %v", err)
+			return
+		}
+	}
+
 	ft.initialRun = false
 }
 
 func (ft *FileTransfer) MethodEngine(ctx, conn context.Context, change *object.Change, path string) error {
-	var prev *string = nil
-	if change != nil {
-		if change.To.Name != "" {
-			prev = &change.To.Name
+	dest := ft.DestinationDirectory
+	return ft.fileTransferPodman(ctx, conn, path, dest, changedName(change, path))
+}
+
+// changedName is the name of the changed file relative to the target path,
+// the old name for a deletion and the new name otherwise
+func changedName(change *object.Change, path string) *string {
+	if change == nil {
+		return nil
+	}
+	if path == deleteFile {
+		if change.From.Name != "" {
+			return &change.From.Name
 		}
+		return nil
 	}
-	dest := ft.DestinationDirectory
-	return ft.fileTransferPodman(ctx, conn, path, dest, prev)
+	if change.To.Name != "" {
+		return &change.To.Name
+	}
+	return nil
 }
 
 func (ft *FileTransfer) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
+	ft.templateData = nil
+	ft.changed = nil
 	changeMap, err := applyChanges(ctx, ft.GetTarget(), ft.GetTargetPath(), ft.Glob, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
-	if err := runChanges(ctx, conn, ft, changeMap); err != nil {
-		return err
+	err = runChanges(ctx, conn, ft, changeMap)
+	if err == nil && ft.Sync {
+		err = ft.pruneDestination(conn, desiredState)
 	}
-	return nil
+	// files placed before a failure still trigger hooks
+	if hookErr := ft.runHooks(conn); hookErr != nil {
+		if err != nil {
+			return utils.WrapErr(err, "%v", hookErr)
+		}
+		return hookErr
+	}
+	return err
+}
+
+func (ft *FileTransfer) statusDetails() interface{} {
+	if len(ft.hookResults) == 0 {
+		return nil
+	}
+	return ft.hookResults
+}
+
+// markChanged records that the content of destFile changed during this run
+func (ft *FileTransfer) markChanged(destFile string) {
+	rel, err := filepath.Rel(ft.DestinationDirectory, destFile)
+	if err != nil {
+		rel = destFile
+	}
+	ft.changed = append(ft.changed, rel)
 }
 
-func (ft *FileTransfer) fileTransferPodman(ctx, conn context.Context, path, dest string, prev *string) error {
-	if prev != nil {
-		pathToRemove := filepath.Join(dest, filepath.Base(*prev))
-		s := generateSpecRemove(filetransferMethod, filepath.Base(pathToRemove), pathToRemove, dest, ft.Name)
-		createResponse, err := createAndStartContainer(conn, s)
+// runHooks runs each hook triggered by the files changed in this run, along with
+// hooks that failed before, and reports every failure
+func (ft *FileTransfer) runHooks(conn context.Context) error {
+	if len(ft.OnChange) == 0 {
+		return nil
+	}
+	if ft.pendingHooks == nil {
+		ft.pendingHooks = make(map[int]int)
+	}
+	for i, h := range ft.OnChange {
+		n, err := h.matches(ft.changed)
 		if err != nil {
 			return err
 		}
-
-		err = waitAndRemoveContainer(conn, createResponse.ID)
+		if n > 0 {
+			ft.pendingHooks[i] += n
+		}
+	}
+	ft.changed = nil
+	ft.hookResults = nil
+	var errs []string
+	for i, h := range ft.OnChange {
+		n, ok := ft.pendingHooks[i]
+		if !ok {
+			continue
+		}
+		klog.Infof("FileTransfer target: %s, %d changed file(s), running hook: %s", ft.Name, n, h)
+		output, err := h.run(conn, ft.Name)
+		result := HookResult{Hook: h.String(), Files: n, Output: output}
 		if err != nil {
-			return err
+			result.Error = err.Error()
+			errs = append(errs, fmt.Sprintf("%s: %v", h, err))
+			klog.Errorf("FileTransfer target: %s, hook %s failed: %v", ft.Name, h, err)
+		} else {
+			delete(ft.pendingHooks, i)
 		}
+		ft.hookResults = append(ft.hookResults, result)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("onChange hooks failed: %s", strings.Join(errs, "; "))
 	}
+	return nil
+}
 
+// destinationPath returns where a file from the target path is placed. With Sync the
+// directory structure below the target path is kept, otherwise files are placed directly
+// in the destination directory. The result never falls outside of the destination directory
+// lexically, the placement script refuses symlinked directories on the host.
+func (ft *FileTransfer) destinationPath(dest, path string, name *string) (string, error) {
+	rel := filepath.Base(path)
+	if name != nil {
+		rel = *name
+	}
+	if !ft.Sync {
+		rel = filepath.Base(rel)
+	}
+	return utils.SafeJoin(dest, rel)
+}
+
+func (ft *FileTransfer) fileTransferPodman(ctx, conn context.Context, path, dest string, name *string) error {
 	if path == deleteFile {
-		return nil
+		if name == nil {
+			return nil
+		}
+		pathToRemove, err := ft.destinationPath(dest, path, name)
+		if err != nil {
+			return err
+		}
+		if err := ft.removeFiles(conn, dest, []string{pathToRemove}); err != nil {
+			return err
+		}
+		ft.markChanged(pathToRemove)
+		return ft.forgetPlaced(pathToRemove)
 	}
 
 	klog.Infof("Deploying file(s) %s", path)
 
 	file := filepath.Base(path)
+	destFile, err := ft.destinationPath(dest, path, name)
+	if err != nil {
+		return err
+	}
 
 	source := filepath.Join("/opt", path)
-	copyFile := (source + " " + dest)
+	if ft.Template {
+		source, err = ft.renderFile(conn, source)
+		if err != nil {
+			return err
+		}
+		// only the checksum of what was placed is kept
+		defer os.Remove(source)
+	}
+	sum, err := fileSHA256(source)
+	if err != nil {
+		return err
+	}
+	prevSum, err := ft.placedSum(destFile)
+	if err != nil {
+		return err
+	}
+	if ft.Template && prevSum == sum {
+		klog.Infof("FileTransfer target: %s, rendered %s unchanged, skipping placement", ft.Name, destFile)
+		return nil
+	}
 
-	s := generateSpec(filetransferMethod, file, copyFile, dest, ft.Name)
+	env, err := ft.placementEnv(conn, source, dest, destFile, sum)
+	if err != nil {
+		return utils.WrapErr(err, "Error preparing placement of %s", path)
+	}
+
+	s := generateSpec(filetransferMethod, file, dest, ft.Name, env)
 	createResponse, err := createAndStartContainer(conn, s)
 	if err != nil {
 		return err
 	}
 
 	// Wait for the container to exit
-	return waitAndRemoveContainer(conn, createResponse.ID)
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("placing %s in %s failed with exit code %d: %s", path, dest, exitCode, output)
+	}
+	if prevSum != sum {
+		ft.markChanged(destFile)
+	}
+	return ft.recordPlaced(destFile, sum)
+}
+
+// placementEnv describes to the placement container where a file goes, the destination
+// directory it must stay in, with which ownership, mode and label, and its expected checksum
+func (ft *FileTransfer) placementEnv(conn context.Context, source, dest, destFile, sum string) (map[string]string, error) {
+	env := map[string]string{
+		"SRC":    source,
+		"ROOT":   filepath.Clean(dest),
+		"DEST":   destFile,
+		"SHA256": sum,
+	}
+	if ft.Mode != "" {
+		if _, err := strconv.ParseUint(ft.Mode, 8, 32); err != nil {
+			return nil, fmt.Errorf("invalid mode %s: %v", ft.Mode, err)
+		}
+		env["MODE"] = ft.Mode
+	}
+	if ft.DirMode != "" {
+		if _, err := strconv.ParseUint(ft.DirMode, 8, 32); err != nil {
+			return nil, fmt.Errorf("invalid dirMode %s: %v", ft.DirMode, err)
+		}
+		env["DIR_MODE"] = ft.DirMode
+	}
+	if ft.SELinuxContext != "" {
+		env["SELINUX_CONTEXT"] = ft.SELinuxContext
+	}
+	if ft.Owner != "" || ft.Group != "" {
+		if ft.chown == nil {
+			uid, gid, err := lookupHostIDs(conn, ft.Owner, ft.Group)
+			if err != nil {
+				return nil, err
+			}
+			chown := uid
+			if gid != "" {
+				chown = uid + ":" + gid
+			}
+			ft.chown = &chown
+		}
+		env["CHOWN"] = *ft.chown
+	}
+	return env, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (ft *FileTransfer) removeFiles(conn context.Context, dest string, pathsToRemove []string) error {
+	klog.Infof("FileTransfer target: %s, removing %d file(s) from %s", ft.Name, len(pathsToRemove), dest)
+	s := generateSpecRemove(filetransferMethod, "remove", pathsToRemove, dest, ft.Name)
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return err
+	}
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("removing files from %s failed with exit code %d: %s", dest, exitCode, output)
+	}
+	return nil
+}
+
+// pruneDestination removes files from the destination directory that are not in the
+// target path at desiredState and do not match an Ignore pattern
+func (ft *FileTransfer) pruneDestination(conn context.Context, desiredState plumbing.Hash) error {
+	dest := filepath.Clean(ft.DestinationDirectory)
+	tree, err := getSubTreeFromHash(getDirectory(ft.GetTarget()), desiredState, ft.GetTargetPath())
+	if err != nil {
+		return err
+	}
+	g, err := compileGlob(ft.Glob)
+	if err != nil {
+		return err
+	}
+	ignore := make([]glob.Glob, 0, len(ft.Ignore))
+	for _, pattern := range ft.Ignore {
+		ig, err := glob.Compile(pattern, '/')
+		if err != nil {
+			return utils.WrapErr(err, "Error compiling ignore pattern %s", pattern)
+		}
+		ignore = append(ignore, ig)
+	}
+
+	wanted := make(map[string]struct{})
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if g.Match(f.Name) {
+			wanted[filepath.Clean(f.Name)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error listing files at %s", desiredState)
+	}
+
+	s := generateSpecList(filetransferMethod, dest, ft.Name)
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return err
+	}
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("listing %s failed with exit code %d: %s", dest, exitCode, output)
+	}
+
+	pathsToRemove := prunePaths(dest, output, wanted, ignore)
+	if len(pathsToRemove) == 0 {
+		return nil
+	}
+	if err := ft.removeFiles(conn, dest, pathsToRemove); err != nil {
+		return err
+	}
+	for _, p := range pathsToRemove {
+		ft.markChanged(p)
+		if err := ft.forgetPlaced(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prunePaths returns the files in the listing of dest printed by listFilesScript that
+// are neither wanted nor ignored, wanted and ignored paths being relative to dest
+func prunePaths(dest, listing string, wanted map[string]struct{}, ignore []glob.Glob) []string {
+	var paths []string
+	for _, line := range strings.Split(listing, "\n") {
+		if !strings.HasPrefix(line, "F:") {
+			continue
+		}
+		p := strings.TrimPrefix(line, "F:")
+		if !utils.IsWithin(dest, p) {
+			continue
+		}
+		rel, err := filepath.Rel(dest, p)
+		if err != nil {
+			continue
+		}
+		if _, ok := wanted[rel]; ok {
+			continue
+		}
+		if matchesAny(ignore, rel) {
+			continue
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// matchesAny is true if rel or one of its parent directories matches a pattern
+func matchesAny(patterns []glob.Glob, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = filepath.Dir(p) {
+		for _, g := range patterns {
+			if g.Match(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderFile renders the template at source into a temporary file in the fetchit cache, which
+// the placement container can read, and returns the rendered file
+func (ft *FileTransfer) renderFile(conn context.Context, source string) (string, error) {
+	if ft.templateData == nil {
+		data, err := ft.gatherTemplateData(conn)
+		if err != nil {
+			return "", err
+		}
+		ft.templateData = data
+	}
+	out, err := renderTemplate(source, ft.templateData)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(ft.cacheDir(), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(ft.cacheDir(), "rendered-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// refreshTemplates renders every file at the current commit again and places
+// those whose rendered content changed since they were last placed
+func (ft *FileTransfer) refreshTemplates(ctx, conn context.Context) error {
+	target := ft.GetTarget()
+	current, err := getCurrent(target, ft.GetKind(), ft.GetName())
+	if err != nil || current.IsZero() {
+		return err
+	}
+	directory := getDirectory(target)
+	tree, err := getSubTreeFromHash(directory, current, ft.GetTargetPath())
+	if err != nil {
+		return err
+	}
+	g, err := compileGlob(ft.Glob)
+	if err != nil {
+		return err
+	}
+	ft.templateData = nil
+	ft.changed = nil
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !g.Match(f.Name) {
+			return nil
+		}
+		name := f.Name
+		path := filepath.Join(directory, ft.GetTargetPath(), name)
+		return ft.fileTransferPodman(ctx, conn, path, ft.DestinationDirectory, &name)
+	})
+	if len(ft.changed) == 0 && len(ft.pendingHooks) == 0 {
+		return err
+	}
+	if hookErr := ft.runHooks(conn); hookErr != nil {
+		if err != nil {
+			err = utils.WrapErr(err, "%v", hookErr)
+		} else {
+			err = hookErr
+		}
+	}
+	recordStatus(ft, current.String(), err)
+	return err
+}
+
+func (ft *FileTransfer) cacheDir() string {
+	return filepath.Join("/opt", ".cache", filetransferMethod, ft.Name)
+}
+
+// trackPlaced is true if the checksums of placed files are recorded
+func (ft *FileTransfer) trackPlaced() bool {
+	return ft.Template || len(ft.OnChange) > 0
+}
+
+func (ft *FileTransfer) loadPlaced() error {
+	if ft.placed != nil {
+		return nil
+	}
+	ft.placed = make(map[string]string)
+	b, err := os.ReadFile(filepath.Join(ft.cacheDir(), "placed.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, &ft.placed)
+}
+
+func (ft *FileTransfer) savePlaced() error {
+	b, err := json.Marshal(ft.placed)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ft.cacheDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ft.cacheDir(), "placed.json"), b, 0600)
+}
+
+// placedSum returns the sha256 of the file last placed at destFile, if known
+func (ft *FileTransfer) placedSum(destFile string) (string, error) {
+	if !ft.trackPlaced() {
+		return "", nil
+	}
+	if err := ft.loadPlaced(); err != nil {
+		return "", err
+	}
+	return ft.placed[destFile], nil
+}
+
+func (ft *FileTransfer) recordPlaced(destFile, sum string) error {
+	if !ft.trackPlaced() {
+		return nil
+	}
+	if err := ft.loadPlaced(); err != nil {
+		return err
+	}
+	ft.placed[destFile] = sum
+	return ft.savePlaced()
+}
+
+func (ft *FileTransfer) forgetPlaced(destFile string) error {
+	if !ft.trackPlaced() {
+		return nil
+	}
+	if err := ft.loadPlaced(); err != nil {
+		return err
+	}
+	delete(ft.placed, destFile)
+	return ft.savePlaced()
 }
@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gobwas/glob"
+)
+
+func TestMatchesAny(t *testing.T) {
+	var patterns []glob.Glob
+	for _, p := range []string{"*.bak", "local", "cache/**"} {
+		patterns = append(patterns, glob.MustCompile(p, '/'))
+	}
+	tests := map[string]bool{
+		"app.bak":             true,
+		"conf/app.bak":        false,
+		"local":               true,
+		"local/override.conf": true,
+		"cache/a/b":           true,
+		"conf/local.conf":     false,
+		"app.conf":            false,
+	}
+	for rel, expected := range tests {
+		if matchesAny(patterns, rel) != expected {
+			t.Errorf("Failed: matchesAny(%q) should be %v", rel, expected)
+		}
+	}
+	if matchesAny(nil, "app.bak") {
+		t.Errorf("Failed: no patterns should match nothing")
+	}
+}
+
+func TestPrunePaths(t *testing.T) {
+	listing := `D:/etc/app/conf
+F:/etc/app/conf/app.conf
+F:/etc/app/conf/old.conf
+F:/etc/app/app.bak
+D:/etc/app/local
+F:/etc/app/local/override.conf
+F:/etc/app/stale
+F:/etc/other/file
+`
+	tests := []struct {
+		name     string
+		wanted   []string
+		ignore   []string
+		expected []string
+	}{
+		{
+			name:     "nothing wanted",
+			expected: []string{"/etc/app/conf/app.conf", "/etc/app/conf/old.conf", "/etc/app/app.bak", "/etc/app/local/override.conf", "/etc/app/stale"},
+		},
+		{
+			name:     "wanted and ignored files are kept",
+			wanted:   []string{"conf/app.conf"},
+			ignore:   []string{"*.bak", "local"},
+			expected: []string{"/etc/app/conf/old.conf", "/etc/app/stale"},
+		},
+		{
+			name:   "everything kept",
+			wanted: []string{"conf/app.conf", "conf/old.conf", "stale"},
+			ignore: []string{"*.bak", "local/*"},
+		},
+	}
+	for _, tt := range tests {
+		wanted := make(map[string]struct{})
+		for _, w := range tt.wanted {
+			wanted[w] = struct{}{}
+		}
+		var ignore []glob.Glob
+		for _, p := range tt.ignore {
+			ignore = append(ignore, glob.MustCompile(p, '/'))
+		}
+		paths := prunePaths("/etc/app", listing, wanted, ignore)
+		if !reflect.DeepEqual(paths, tt.expected) {
+			t.Errorf("Failed %s: expected %v, got %v", tt.name, tt.expected, paths)
+		}
+	}
+}
+
+func TestDestinationPath(t *testing.T) {
+	name := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		sync     bool
+		file     *string
+		expected string
+		err      bool
+	}{
+		{name: "flat", file: name("conf/app.conf"), expected: "/etc/app/app.conf"},
+		{name: "sync", sync: true, file: name("conf/app.conf"), expected: "/etc/app/conf/app.conf"},
+		{name: "path only", expected: "/etc/app/app.conf"},
+		{name: "escape", sync: true, file: name("../../passwd"), err: true},
+	}
+	for _, tt := range tests {
+		ft := &FileTransfer{Sync: tt.sync}
+		dest, err := ft.destinationPath("/etc/app", "repo/conf/app.conf", tt.file)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Failed %s: expected error, got %s", tt.name, dest)
+			}
+			continue
+		}
+		if err != nil || dest != tt.expected {
+			t.Errorf("Failed %s: expected %s, got %s: %v", tt.name, tt.expected, dest, err)
+		}
+	}
+}
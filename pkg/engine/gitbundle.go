@@ -0,0 +1,271 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"k8s.io/klog/v2"
+)
+
+const (
+	gitBundleV2 = "# v2 git bundle"
+	gitBundleV3 = "# v3 git bundle"
+)
+
+// gitBundle is the header of a file created by git bundle create
+type gitBundle struct {
+	// Prerequisites are commits the repository must already have
+	Prerequisites []plumbing.Hash
+	// References are the refs the bundle carries
+	References map[plumbing.ReferenceName]plumbing.Hash
+	// packOffset is where the packfile starts
+	packOffset int64
+}
+
+// isGitBundle is true if the file at path starts with a git bundle signature
+func isGitBundle(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return line == gitBundleV2 || line == gitBundleV3
+}
+
+// readGitBundleHeader parses the signature, capabilities, prerequisites and references of a bundle
+func readGitBundleHeader(r io.Reader) (*gitBundle, error) {
+	br := bufio.NewReader(r)
+	b := &gitBundle{References: make(map[plumbing.ReferenceName]plumbing.Hash)}
+	first := true
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error reading git bundle header")
+		}
+		b.packOffset += int64(len(line))
+		line = strings.TrimSuffix(line, "\n")
+		if first {
+			if line != gitBundleV2 && line != gitBundleV3 {
+				return nil, fmt.Errorf("not a git bundle")
+			}
+			first = false
+			continue
+		}
+		switch {
+		case line == "":
+			return b, nil
+		case strings.HasPrefix(line, "@"):
+			// v3 capabilities, only sha1 repositories are supported
+			if strings.HasPrefix(line, "@object-format=") && line != "@object-format=sha1" {
+				return nil, fmt.Errorf("unsupported git bundle capability %s", line)
+			}
+		case strings.HasPrefix(line, "-"):
+			fields := strings.Fields(line[1:])
+			if len(fields) == 0 || !plumbing.IsHash(fields[0]) {
+				return nil, fmt.Errorf("invalid git bundle prerequisite %q", line)
+			}
+			b.Prerequisites = append(b.Prerequisites, plumbing.NewHash(fields[0]))
+		default:
+			fields := strings.Fields(line)
+			if len(fields) != 2 || !plumbing.IsHash(fields[0]) {
+				return nil, fmt.Errorf("invalid git bundle reference %q", line)
+			}
+			b.References[plumbing.ReferenceName(fields[1])] = plumbing.NewHash(fields[0])
+		}
+	}
+}
+
+// applyGitBundle fetches branch from the bundle at path into the repository in directory, as git
+// fetch would, so that history and current tags are kept and only new objects need to be shipped.
+// A bundle without prerequisites creates the repository if it does not exist yet.
+func applyGitBundle(directory, path, branch string) (plumbing.Hash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer f.Close()
+	bundle, err := readGitBundleHeader(f)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	refName := plumbing.NewBranchReferenceName(branch)
+	hash, ok := bundle.References[refName]
+	if !ok {
+		if hash, ok = bundle.References[plumbing.HEAD]; !ok {
+			return plumbing.ZeroHash, fmt.Errorf("git bundle %s does not contain %s", path, refName)
+		}
+	}
+
+	repo, err := git.PlainOpen(directory)
+	initialized := false
+	if err == git.ErrRepositoryNotExists {
+		if len(bundle.Prerequisites) > 0 {
+			return plumbing.ZeroHash, fmt.Errorf("git bundle %s is incremental and requires an existing clone in %s", path, directory)
+		}
+		repo, err = git.PlainInit(directory, false)
+		initialized = true
+	}
+	if err != nil {
+		return plumbing.ZeroHash, utils.WrapErr(err, "Error opening repository %s", directory)
+	}
+
+	var missing []string
+	for _, p := range bundle.Prerequisites {
+		if repo.Storer.HasEncodedObject(p) != nil {
+			missing = append(missing, p.String())
+		}
+	}
+	if len(missing) > 0 {
+		return plumbing.ZeroHash, fmt.Errorf("repository %s is missing commits required by git bundle %s: %s", directory, path, strings.Join(missing, ", "))
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	// the parser resolves deltas against objects already in the repository, as bundles are thin packs
+	pack := io.NewSectionReader(f, bundle.packOffset, fi.Size()-bundle.packOffset)
+	parser, err := packfile.NewParserWithStorage(packfile.NewScanner(pack), repo.Storer)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := parser.Parse(); err != nil {
+		return plumbing.ZeroHash, utils.WrapErr(err, "Error reading packfile of git bundle %s", path)
+	}
+	if _, err := repo.CommitObject(hash); err != nil {
+		return plumbing.ZeroHash, utils.WrapErr(err, "Error reading commit %s from git bundle %s", hash, path)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(refName, hash)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if initialized {
+		if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, refName)); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	klog.Infof("Fetched %s at %s from git bundle %s", refName, hash, path)
+	return hash, nil
+}
+
+// bundleStatePath is where the checksum and validators of the last bundle applied to directory are kept
+func bundleStatePath(directory string) string {
+	return filepath.Join("/opt", ".cache", directory, "bundle.json")
+}
+
+func loadBundleState(directory string) (*httpSource, error) {
+	b, err := os.ReadFile(bundleStatePath(directory))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &httpSource{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveBundleState(directory string, state *httpSource) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(bundleStatePath(directory)), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(bundleStatePath(directory), b, 0600)
+}
+
+// applyGitBundleOnce applies the bundle at path unless it is the bundle last applied to the target
+func applyGitBundleOnce(target *Target, path string, state *httpSource) error {
+	directory := getDirectory(target)
+	previous, err := loadBundleState(directory)
+	if err != nil {
+		return err
+	}
+	if state.Sha256 == "" {
+		if state.Sha256, err = fileSHA256(path); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(directory); err == nil && previous != nil && previous.Sha256 == state.Sha256 {
+		return saveBundleState(directory, state)
+	}
+	if _, err := applyGitBundle(directory, path, target.branch); err != nil {
+		return err
+	}
+	return saveBundleState(directory, state)
+}
+
+// fetchDeviceRepository updates a disconnected target from its device, fetching from
+// <directory>.bundle at the root of the device if there is one, and otherwise copying
+// the repository directory from the device. A target without a name is the whole device.
+func fetchDeviceRepository(target *Target) error {
+	directory := getDirectory(target)
+	bundlePath := filepath.Join(bundleCacheDir, directory+".bundle")
+	os.Remove(bundlePath)
+	bundled := false
+	present, err := withDevice(target.device, func(mountPoint string) error {
+		var err error
+		bundled, err = copyDeviceRepository(mountPoint, directory, filepath.Join("/opt", directory), bundlePath)
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error copying %s from device %s", directory, target.device)
+	}
+	if !present {
+		// remove the diff file
+		os.Remove("/opt/.cache/" + directory + "/HEAD")
+		klog.Info("Device not present...requeuing")
+		return nil
+	}
+	if bundled {
+		defer os.Remove(bundlePath)
+		return applyGitBundleOnce(target, bundlePath, &httpSource{})
+	}
+	return createDiffFile(directory)
+}
+
+// copyDeviceRepository copies what the device mounted at mountPoint holds for the repository
+// directory: <directory>.bundle to bundlePath if it is a git bundle, and otherwise the <directory>
+// directory to dest. Devices written before named targets were read from their own directory hold
+// the repository at the root, which is copied when there is no <directory> directory. It reports
+// whether a bundle was copied.
+func copyDeviceRepository(mountPoint, directory, dest, bundlePath string) (bool, error) {
+	if directory != "." {
+		src, err := utils.SafeJoin(mountPoint, directory+".bundle")
+		if err != nil {
+			return false, err
+		}
+		if isGitBundle(src) {
+			if err := os.MkdirAll(filepath.Dir(bundlePath), 0700); err != nil {
+				return false, err
+			}
+			return true, copyFromDevice(src, bundlePath)
+		}
+		src = filepath.Join(mountPoint, directory)
+		if _, err := os.Stat(src); err == nil {
+			return false, copyFromDevice(src, dest)
+		}
+		klog.Infof("No %s directory on the device, copying the repository at its root", directory)
+	}
+	return false, copyFromDevice(mountPoint, dest)
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestReadGitBundleHeader(t *testing.T) {
+	header := "# v2 git bundle\n" +
+		"-0c530e174d6f5facfd7f7cb15bde9fa8f6292c19 c2\n" +
+		"5cdd98c2dc785ded0d2c8a866bdca977ec35edf9 refs/heads/main\n" +
+		"\n"
+	b, err := readGitBundleHeader(strings.NewReader(header + "PACK"))
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if len(b.Prerequisites) != 1 || b.Prerequisites[0].String() != "0c530e174d6f5facfd7f7cb15bde9fa8f6292c19" {
+		t.Fatalf("Failed: unexpected prerequisites %v", b.Prerequisites)
+	}
+	if b.References[plumbing.NewBranchReferenceName("main")].String() != "5cdd98c2dc785ded0d2c8a866bdca977ec35edf9" {
+		t.Fatalf("Failed: unexpected references %v", b.References)
+	}
+	if b.packOffset != int64(len(header)) {
+		t.Fatalf("Failed: pack offset %d != %d", b.packOffset, len(header))
+	}
+
+	v3 := "# v3 git bundle\n@object-format=sha256\n\n"
+	if _, err := readGitBundleHeader(strings.NewReader(v3)); err == nil {
+		t.Fatalf("Failed: expected error for sha256 bundle")
+	}
+	if _, err := readGitBundleHeader(strings.NewReader("PK\x03\x04")); err == nil {
+		t.Fatalf("Failed: expected error for a zip file")
+	}
+}
+
+func TestCopyDeviceRepository(t *testing.T) {
+	src := t.TempDir()
+	repo, err := git.PlainInit(src, false)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	first := commitFile(t, repo, src, "a.json", "{}")
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	branch := head.Name().Short()
+
+	// a named target fetches <name>.bundle from the root of the device
+	mountPoint := t.TempDir()
+	if err := writeGitBundle(src, branch, "", filepath.Join(mountPoint, "fetchit.bundle")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	bundlePath := filepath.Join(t.TempDir(), "bundles", "fetchit.bundle")
+	dest := filepath.Join(t.TempDir(), "fetchit")
+	bundled, err := copyDeviceRepository(mountPoint, "fetchit", dest, bundlePath)
+	if err != nil || !bundled {
+		t.Fatalf("Failed: bundle not copied, %v", err)
+	}
+	if hash, err := applyGitBundle(dest, bundlePath, branch); err != nil || hash != first {
+		t.Fatalf("Failed: applied %s, %v", hash, err)
+	}
+
+	// without a bundle, the <name> directory is copied, or the root of older devices
+	for name, layout := range map[string]string{"directory": "fetchit", "root": "."} {
+		mountPoint := t.TempDir()
+		if err := copyFromDevice(src, filepath.Join(mountPoint, layout)); err != nil {
+			t.Fatalf("Failed: %s: %v", name, err)
+		}
+		dest := filepath.Join(t.TempDir(), "fetchit")
+		if bundled, err := copyDeviceRepository(mountPoint, "fetchit", dest, bundlePath); err != nil || bundled {
+			t.Fatalf("Failed: %s: bundled %t, %v", name, bundled, err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, ".git", "HEAD")); err != nil {
+			t.Fatalf("Failed: %s: repository not copied: %v", name, err)
+		}
+	}
+}
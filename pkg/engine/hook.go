@@ -0,0 +1,269 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/common/pkg/signal"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/api/handlers"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/gobwas/glob"
+	"k8s.io/klog/v2"
+)
+
+const (
+	hookRestart = "restart"
+	hookReload  = "reload"
+	hookSignal  = "signal"
+	hookExec    = "exec"
+)
+
+// Hook is an action run after a FileTransfer places files whose content changed
+type Hook struct {
+	// A glob, relative to the destination directory, of the files that trigger the hook
+	// Defaults to every placed file
+	Glob *string `mapstructure:"glob"`
+	// Systemd unit to restart or reload
+	Unit string `mapstructure:"unit"`
+	// If true, Unit is a system unit, otherwise a user unit
+	Root bool `mapstructure:"root"`
+	// User whose session manages Unit, a name or UID on the host
+	User string `mapstructure:"user"`
+	// Name of the podman container to act on
+	Container string `mapstructure:"container"`
+	// Label selecting podman containers to act on, e.g. app=web
+	Label string `mapstructure:"label"`
+	// Action is restart or reload for units, and restart, signal or exec for containers
+	Action string `mapstructure:"action"`
+	// Signal sent to containers with the signal action, defaults to SIGHUP
+	Signal string `mapstructure:"signal"`
+	// Command run in containers with the exec action
+	Command []string `mapstructure:"command"`
+}
+
+// HookResult is the outcome of a hook, reported with the FileTransfer status
+type HookResult struct {
+	Hook   string `json:"hook"`
+	Files  int    `json:"files"`
+	Error  string `json:"error,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+func (h *Hook) String() string {
+	if h.Unit != "" {
+		return fmt.Sprintf("%s unit %s", h.Action, h.Unit)
+	}
+	if h.Label != "" {
+		return fmt.Sprintf("%s containers with label %s", h.Action, h.Label)
+	}
+	return fmt.Sprintf("%s container %s", h.Action, h.Container)
+}
+
+// matches returns how many of the changed files, relative to the destination directory, trigger the hook
+func (h *Hook) matches(changed []string) (int, error) {
+	if h.Glob == nil {
+		return len(changed), nil
+	}
+	g, err := glob.Compile(*h.Glob, '/')
+	if err != nil {
+		return 0, utils.WrapErr(err, "Error compiling hook glob %s", *h.Glob)
+	}
+	n := 0
+	for _, f := range changed {
+		if g.Match(f) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// validate checks that the hook names one unit, container or label, an action it supports, and
+// a valid signal and glob, so a broken hook fails the config instead of the run it fires after
+func (h *Hook) validate() []string {
+	var problems []string
+	set := 0
+	for _, v := range []string{h.Unit, h.Container, h.Label} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		problems = append(problems, "must set exactly one of unit, container or label")
+	}
+	switch {
+	case h.Unit != "":
+		if h.Action != hookRestart && h.Action != hookReload {
+			problems = append(problems, fmt.Sprintf("unit action must be %s or %s, not %q", hookRestart, hookReload, h.Action))
+		}
+	case h.Container != "" || h.Label != "":
+		if h.Action != hookRestart && h.Action != hookSignal && h.Action != hookExec {
+			problems = append(problems, fmt.Sprintf("container action must be %s, %s or %s, not %q", hookRestart, hookSignal, hookExec, h.Action))
+		}
+		if h.Action == hookExec && len(h.Command) == 0 {
+			problems = append(problems, "exec action requires a command")
+		}
+	}
+	if h.Signal != "" {
+		if h.Action != hookSignal {
+			problems = append(problems, "signal is only used with the signal action")
+		} else if _, err := signal.ParseSignalNameOrNumber(h.Signal); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid signal %q", h.Signal))
+		}
+	}
+	if h.Glob != nil {
+		if _, err := glob.Compile(*h.Glob, '/'); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid glob %q: %v", *h.Glob, err))
+		}
+	}
+	return problems
+}
+
+// containerActions are what hooks do to containers
+type containerActions interface {
+	restart(container string) error
+	kill(container, signal string) error
+	exec(container string, command []string) (string, error)
+}
+
+// podmanContainers acts on containers through the podman connection
+type podmanContainers struct {
+	conn context.Context
+}
+
+func (p podmanContainers) restart(container string) error {
+	return containers.Restart(p.conn, container, nil)
+}
+
+func (p podmanContainers) kill(container, signal string) error {
+	return containers.Kill(p.conn, container, new(containers.KillOptions).WithSignal(signal))
+}
+
+func (p podmanContainers) exec(container string, command []string) (string, error) {
+	return execInContainer(p.conn, container, command)
+}
+
+// run carries out the hook's action
+func (h *Hook) run(conn context.Context, name string) (string, error) {
+	if h.Unit != "" {
+		return "", h.runUnit(conn, name)
+	}
+	targets, err := h.containers(conn)
+	if err != nil {
+		return "", err
+	}
+	return h.runContainers(podmanContainers{conn}, targets)
+}
+
+// runContainers carries out the hook's action on each container, stopping at the first failure
+func (h *Hook) runContainers(actions containerActions, targets []string) (string, error) {
+	var output strings.Builder
+	for _, c := range targets {
+		var err error
+		switch h.Action {
+		case hookRestart:
+			err = actions.restart(c)
+		case hookSignal:
+			signal := h.Signal
+			if signal == "" {
+				signal = "SIGHUP"
+			}
+			err = actions.kill(c, signal)
+		case hookExec:
+			var out string
+			out, err = actions.exec(c, h.Command)
+			output.WriteString(out)
+		default:
+			err = fmt.Errorf("unknown container hook action %q", h.Action)
+		}
+		if err != nil {
+			return output.String(), utils.WrapErr(err, "Error running %s on container %s", h.Action, c)
+		}
+	}
+	return output.String(), nil
+}
+
+func (h *Hook) runUnit(conn context.Context, name string) error {
+	if h.Action != hookRestart && h.Action != hookReload {
+		return fmt.Errorf("unknown unit hook action %q", h.Action)
+	}
+	sd := &Systemd{
+		CommonMethod: CommonMethod{
+			Name: name,
+		},
+		Root: h.Root,
+		User: h.User,
+	}
+	dest, err := sd.unitDir(conn)
+	if err != nil {
+		return err
+	}
+	return sd.enableRestartSystemdService(conn, h.Action, dest, h.Unit)
+}
+
+// containers returns the container named by the hook or those carrying its label
+func (h *Hook) containers(conn context.Context) ([]string, error) {
+	if h.Label == "" {
+		if h.Container == "" {
+			return nil, fmt.Errorf("hook must set one of unit, container or label")
+		}
+		return []string{h.Container}, nil
+	}
+	list, err := containers.List(conn, new(containers.ListOptions).WithFilters(map[string][]string{"label": {h.Label}}))
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error listing containers with label %s", h.Label)
+	}
+	var names []string
+	for _, c := range list {
+		if len(c.Names) > 0 {
+			names = append(names, c.Names[0])
+		} else {
+			names = append(names, c.ID)
+		}
+	}
+	if len(names) == 0 {
+		klog.Infof("No running containers with label %s", h.Label)
+	}
+	return names, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// execInContainer runs command in a running container and returns its output,
+// failing if the command exits non-zero
+func execInContainer(conn context.Context, container string, command []string) (string, error) {
+	if len(command) == 0 {
+		return "", fmt.Errorf("exec hook requires a command")
+	}
+	execConfig := new(handlers.ExecCreateConfig)
+	execConfig.Cmd = command
+	execConfig.AttachStdout = true
+	execConfig.AttachStderr = true
+	sessionID, err := containers.ExecCreate(conn, container, execConfig)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	var w io.WriteCloser = nopWriteCloser{&out}
+	options := new(containers.ExecStartAndAttachOptions).WithOutputStream(w).WithErrorStream(w).WithAttachOutput(true).WithAttachError(true)
+	if err := containers.ExecStartAndAttach(conn, sessionID, options); err != nil {
+		return out.String(), err
+	}
+	inspect, err := containers.ExecInspect(conn, sessionID, nil)
+	if err != nil {
+		return out.String(), err
+	}
+	if inspect.ExitCode != 0 {
+		return out.String(), fmt.Errorf("%s exited with %d", strings.Join(command, " "), inspect.ExitCode)
+	}
+	return out.String(), nil
+}
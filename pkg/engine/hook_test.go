@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHookMatches(t *testing.T) {
+	glob := func(s string) *string { return &s }
+	changed := []string{"nginx.conf", "conf.d/site.conf", "conf.d/site.conf.bak", "html/index.html"}
+	tests := []struct {
+		glob     *string
+		expected int
+	}{
+		{glob: nil, expected: 4},
+		{glob: glob("*.conf"), expected: 1},
+		{glob: glob("**.conf"), expected: 2},
+		{glob: glob("conf.d/*"), expected: 2},
+		{glob: glob("*.yaml"), expected: 0},
+	}
+	for _, tt := range tests {
+		n, err := (&Hook{Glob: tt.glob}).matches(changed)
+		if err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		if n != tt.expected {
+			t.Errorf("Failed: glob %v matched %d files, expected %d", tt.glob, n, tt.expected)
+		}
+	}
+	if _, err := (&Hook{Glob: glob("[a")}).matches(changed); err == nil {
+		t.Errorf("Failed: expected error for an invalid glob")
+	}
+}
+
+// recordedActions records what a hook does to containers
+type recordedActions struct {
+	calls []string
+	fail  string
+}
+
+func (r *recordedActions) restart(container string) error {
+	r.calls = append(r.calls, "restart "+container)
+	return r.failure(container)
+}
+
+func (r *recordedActions) kill(container, signal string) error {
+	r.calls = append(r.calls, "kill "+container+" "+signal)
+	return r.failure(container)
+}
+
+func (r *recordedActions) exec(container string, command []string) (string, error) {
+	r.calls = append(r.calls, "exec "+container+" "+strings.Join(command, " "))
+	return container + " reloaded\n", r.failure(container)
+}
+
+func (r *recordedActions) failure(container string) error {
+	if container == r.fail {
+		return fmt.Errorf("%s failed", container)
+	}
+	return nil
+}
+
+func TestHookRunContainers(t *testing.T) {
+	tests := []struct {
+		name   string
+		hook   Hook
+		fail   string
+		calls  []string
+		output string
+		err    bool
+	}{
+		{
+			name:  "restart",
+			hook:  Hook{Label: "app=web", Action: hookRestart},
+			calls: []string{"restart web1", "restart web2"},
+		},
+		{
+			name:  "signal defaults to SIGHUP",
+			hook:  Hook{Label: "app=web", Action: hookSignal},
+			calls: []string{"kill web1 SIGHUP", "kill web2 SIGHUP"},
+		},
+		{
+			name:  "signal",
+			hook:  Hook{Label: "app=web", Action: hookSignal, Signal: "SIGUSR1"},
+			calls: []string{"kill web1 SIGUSR1", "kill web2 SIGUSR1"},
+		},
+		{
+			name:   "exec",
+			hook:   Hook{Label: "app=web", Action: hookExec, Command: []string{"nginx", "-s", "reload"}},
+			calls:  []string{"exec web1 nginx -s reload", "exec web2 nginx -s reload"},
+			output: "web1 reloaded\nweb2 reloaded\n",
+		},
+		{
+			name:  "stops at the first failure",
+			hook:  Hook{Label: "app=web", Action: hookRestart},
+			fail:  "web1",
+			calls: []string{"restart web1"},
+			err:   true,
+		},
+		{
+			name: "unknown action",
+			hook: Hook{Label: "app=web", Action: "stop"},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		actions := &recordedActions{fail: tt.fail}
+		output, err := tt.hook.runContainers(actions, []string{"web1", "web2"})
+		if (err != nil) != tt.err {
+			t.Errorf("Failed %s: unexpected error %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(actions.calls, tt.calls) {
+			t.Errorf("Failed %s: expected %v, got %v", tt.name, tt.calls, actions.calls)
+		}
+		if output != tt.output {
+			t.Errorf("Failed %s: expected output %q, got %q", tt.name, tt.output, output)
+		}
+	}
+}
+
+func TestHookValidate(t *testing.T) {
+	glob := "[a"
+	tests := []struct {
+		name     string
+		hook     Hook
+		problems []string
+	}{
+		{name: "unit", hook: Hook{Unit: "nginx.service", Root: true, Action: hookReload}},
+		{name: "exec", hook: Hook{Container: "web", Action: hookExec, Command: []string{"true"}}},
+		{name: "signal", hook: Hook{Label: "app=web", Action: hookSignal, Signal: "USR1"}},
+		{name: "nothing to act on", hook: Hook{Action: hookRestart}, problems: []string{"must set exactly one"}},
+		{name: "several to act on", hook: Hook{Unit: "nginx.service", Container: "web", Action: hookRestart}, problems: []string{"must set exactly one"}},
+		{name: "unit action", hook: Hook{Unit: "nginx.service", Action: hookSignal}, problems: []string{"unit action must be"}},
+		{name: "container action", hook: Hook{Container: "web", Action: hookReload}, problems: []string{"container action must be"}},
+		{name: "exec without command", hook: Hook{Container: "web", Action: hookExec}, problems: []string{"requires a command"}},
+		{name: "invalid signal", hook: Hook{Container: "web", Action: hookSignal, Signal: "SIGNOPE"}, problems: []string{"invalid signal"}},
+		{name: "signal without signal action", hook: Hook{Container: "web", Action: hookRestart, Signal: "HUP"}, problems: []string{"only used with the signal action"}},
+		{name: "invalid glob", hook: Hook{Container: "web", Action: hookRestart, Glob: &glob}, problems: []string{"invalid glob"}},
+	}
+	for _, tt := range tests {
+		problems := tt.hook.validate()
+		if len(problems) != len(tt.problems) {
+			t.Errorf("Failed %s: expected %v, got %v", tt.name, tt.problems, problems)
+			continue
+		}
+		for i, want := range tt.problems {
+			if !strings.Contains(problems[i], want) {
+				t.Errorf("Failed %s: expected %q, got %q", tt.name, want, problems[i])
+			}
+		}
+	}
+}
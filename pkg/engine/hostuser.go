@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"k8s.io/klog/v2"
+)
+
+const (
+	hostRoot      = "/proc/1/root"
+	logindMarker  = "LOGIND:"
+	logindUserDir = "/run/systemd/users"
+	groupMarker   = "GROUP:"
+)
+
+// hostUser is an account on the host, resolved from the host's passwd
+// database and logind state rather than from within the fetchit container
+type hostUser struct {
+	Name       string
+	UID        int
+	GID        int
+	Home       string
+	RuntimeDir string
+}
+
+// busAddress is the user's session bus, used by systemctl --user
+func (u *hostUser) busAddress() string {
+	return "unix:path=" + filepath.Join(u.RuntimeDir, "bus")
+}
+
+// userSpec is the user the systemd method container runs as
+func (u *hostUser) userSpec() string {
+	return fmt.Sprintf("%d:%d", u.UID, u.GID)
+}
+
+// userDirScript returns a command creating dir, a directory below the user's home, and each
+// missing directory above it, owned by the user, through the host filesystem
+func userDirScript(u *hostUser, dir string) (string, error) {
+	rel, err := filepath.Rel(u.Home, dir)
+	if err != nil || !utils.IsWithin(u.Home, dir) {
+		return "", fmt.Errorf("%s is not below the home directory %s of user %s", dir, u.Home, u.Name)
+	}
+	var commands []string
+	path := filepath.Join(hostRoot, u.Home)
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		quoted := "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+		commands = append(commands, fmt.Sprintf("[ -d %s ] || { mkdir %s && chown %s %s; }", quoted, quoted, u.userSpec(), quoted))
+	}
+	return "set -e\n" + strings.Join(commands, "\n") + "\n", nil
+}
+
+// lookupHostUser resolves a user name or UID on the host. The fetchit container
+// does not share the host's /etc/passwd, so it is read along with the logind
+// user records through /proc/1/root.
+func lookupHostUser(conn context.Context, nameOrUID string) (*hostUser, error) {
+	passwd := filepath.Join(hostRoot, "etc", "passwd")
+	users := filepath.Join(hostRoot, logindUserDir)
+	output, err := runHostCommand(conn, "systemd-user-lookup-"+nameOrUID, "cat "+passwd+"; for f in "+users+"/*; do [ -f \"$f\" ] || continue; echo \""+logindMarker+"$(basename \"$f\")\"; cat \"$f\"; done")
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading host passwd database")
+	}
+	return parseHostUser(nameOrUID, output)
+}
+
+// lookupHostIDs resolves an owner and group, given as names or numeric IDs,
+// to numeric IDs using the host's passwd and group databases
+func lookupHostIDs(conn context.Context, owner, group string) (string, string, error) {
+	if isNumericID(owner) && isNumericID(group) {
+		return owner, group, nil
+	}
+	passwd := filepath.Join(hostRoot, "etc", "passwd")
+	groups := filepath.Join(hostRoot, "etc", "group")
+	output, err := runHostCommand(conn, "owner-lookup-"+owner+"-"+group, "cat "+passwd+"; echo "+groupMarker+"; cat "+groups)
+	if err != nil {
+		return "", "", utils.WrapErr(err, "Error reading host passwd and group databases")
+	}
+	return parseHostIDs(owner, group, output)
+}
+
+func isNumericID(id string) bool {
+	if id == "" {
+		return true
+	}
+	_, err := strconv.Atoi(id)
+	return err == nil
+}
+
+// parseHostIDs finds owner in passwd entries and group in group entries that follow a GROUP: line
+func parseHostIDs(owner, group, output string) (string, string, error) {
+	uid, gid := owner, group
+	foundUser, foundGroup := isNumericID(owner), isNumericID(group)
+	inGroups := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == groupMarker {
+			inGroups = true
+			continue
+		}
+		// passwd is name:password:UID:..., group is name:password:GID:...
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if !inGroups && !foundUser && fields[0] == owner {
+			uid, foundUser = fields[2], true
+		}
+		if inGroups && !foundGroup && fields[0] == group {
+			gid, foundGroup = fields[2], true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if !foundUser {
+		return "", "", fmt.Errorf("user %s not found in host passwd database", owner)
+	}
+	if !foundGroup {
+		return "", "", fmt.Errorf("group %s not found in host group database", group)
+	}
+	return uid, gid, nil
+}
+
+// invalidNameChars are the characters podman does not allow in container names
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// helperContainerName turns name, which may hold user and group names from the config, into a
+// valid container name with a random suffix, so helpers started at the same time never collide
+func helperContainerName(name string) string {
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), "-.")
+	if name == "" {
+		name = "fetchit-helper"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return name + "-" + hex.EncodeToString(suffix)
+}
+
+// runHostCommand runs command in a fetchit container in the host pid namespace,
+// where the host filesystem is reachable through /proc/1/root, and returns its output
+func runHostCommand(conn context.Context, name, command string) (string, error) {
+	if err := detectOrFetchImage(conn, fetchitImage, false); err != nil {
+		return "", err
+	}
+	s := specgen.NewSpecGenerator(fetchitImage, false)
+	s.Name = helperContainerName(name)
+	s.Privileged = true
+	s.PidNS = specgen.Namespace{
+		NSMode: "host",
+		Value:  "",
+	}
+	s.Command = []string{"sh", "-c", command}
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return "", err
+	}
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("%s exited with %d: %s", name, exitCode, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// parseHostUser finds nameOrUID in passwd entries, followed by logind user
+// records each introduced by a LOGIND:<uid> line
+func parseHostUser(nameOrUID, output string) (*hostUser, error) {
+	var user *hostUser
+	runtimeDirs := make(map[string]string)
+	logindUID := ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, logindMarker) {
+			logindUID = strings.TrimPrefix(line, logindMarker)
+			continue
+		}
+		if logindUID != "" {
+			if strings.HasPrefix(line, "RUNTIME=") {
+				runtimeDirs[logindUID] = strings.TrimPrefix(line, "RUNTIME=")
+			}
+			continue
+		}
+		if user != nil || line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:UID:GID:GECOS:directory:shell
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+		if fields[0] != nameOrUID && fields[2] != nameOrUID {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID %q for user %s", fields[2], fields[0])
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid GID %q for user %s", fields[3], fields[0])
+		}
+		user = &hostUser{
+			Name: fields[0],
+			UID:  uid,
+			GID:  gid,
+			Home: fields[5],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s not found in host passwd database", nameOrUID)
+	}
+	if user.UID == 0 {
+		return nil, fmt.Errorf("user %s is root, set root: true instead", nameOrUID)
+	}
+	if dir, ok := runtimeDirs[strconv.Itoa(user.UID)]; ok && dir != "" {
+		user.RuntimeDir = dir
+	} else {
+		// logind has no record of the user until a session starts or linger is enabled
+		user.RuntimeDir = filepath.Join("/run", "user", strconv.Itoa(user.UID))
+		klog.Infof("No logind session found for user %s, assuming runtime directory %s", user.Name, user.RuntimeDir)
+	}
+	return user, nil
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseHostUser(t *testing.T) {
+	output := `root:x:0:0:root:/root:/bin/bash
+svc-web:x:1001:1001::/home/svc-web:/bin/bash
+svc-db:x:1002:990::/var/lib/svc-db:/sbin/nologin
+LOGIND:1001
+# This is private data. Do not parse.
+NAME=svc-web
+STATE=lingering
+RUNTIME=/run/user/1001
+`
+	u, err := parseHostUser("svc-web", output)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if u.UID != 1001 || u.GID != 1001 || u.Home != "/home/svc-web" || u.RuntimeDir != "/run/user/1001" {
+		t.Fatalf("Failed: unexpected user %+v", u)
+	}
+
+	u, err = parseHostUser("1002", output)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if u.Name != "svc-db" || u.GID != 990 || u.RuntimeDir != "/run/user/1002" {
+		t.Fatalf("Failed: unexpected user %+v", u)
+	}
+
+	if _, err := parseHostUser("root", output); err == nil {
+		t.Fatalf("Failed: expected error for root user")
+	}
+	if _, err := parseHostUser("missing", output); err == nil {
+		t.Fatalf("Failed: expected error for missing user")
+	}
+}
+
+func TestUserDirScript(t *testing.T) {
+	u := &hostUser{Name: "svc-web", UID: 1001, GID: 1001, Home: "/home/svc-web"}
+	script, err := userDirScript(u, "/home/svc-web/.config/systemd/user")
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	expected := "set -e\n" +
+		"[ -d '/proc/1/root/home/svc-web/.config' ] || { mkdir '/proc/1/root/home/svc-web/.config' && chown 1001:1001 '/proc/1/root/home/svc-web/.config'; }\n" +
+		"[ -d '/proc/1/root/home/svc-web/.config/systemd' ] || { mkdir '/proc/1/root/home/svc-web/.config/systemd' && chown 1001:1001 '/proc/1/root/home/svc-web/.config/systemd'; }\n" +
+		"[ -d '/proc/1/root/home/svc-web/.config/systemd/user' ] || { mkdir '/proc/1/root/home/svc-web/.config/systemd/user' && chown 1001:1001 '/proc/1/root/home/svc-web/.config/systemd/user'; }\n"
+	if script != expected {
+		t.Fatalf("Failed: unexpected script\n%s", script)
+	}
+	if _, err := userDirScript(u, "/etc/systemd/system"); err == nil {
+		t.Fatalf("Failed: expected error for a directory outside of the home directory")
+	}
+}
+
+func TestHelperContainerName(t *testing.T) {
+	tests := map[string]string{
+		"systemd-user-lookup-svc-web":       "systemd-user-lookup-svc-web-",
+		"owner-lookup-DOMAIN\\jane-web team": "owner-lookup-DOMAIN-jane-web-team-",
+		"owner-lookup--":                    "owner-lookup-",
+		"@@@":                               "fetchit-helper-",
+	}
+	valid := regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	for name, prefix := range tests {
+		got := helperContainerName(name)
+		if !strings.HasPrefix(got, prefix) || len(got) != len(prefix)+8 || !valid.MatchString(got) {
+			t.Errorf("Failed: %q became %q, expected %q and a suffix", name, got, prefix)
+		}
+	}
+	if helperContainerName("host-facts") == helperContainerName("host-facts") {
+		t.Errorf("Failed: helpers with the same name should not collide")
+	}
+}
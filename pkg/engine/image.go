@@ -1,15 +1,25 @@
 package engine
 
 import (
+	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/pkg/compression"
 	"github.com/containers/podman/v4/pkg/bindings/containers"
 	"github.com/containers/podman/v4/pkg/bindings/images"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -17,7 +27,11 @@ import (
 	"k8s.io/klog/v2"
 )
 
-const imageMethod = "image"
+const (
+	imageMethod = "image"
+	// systemdUnitLabel is set by podman on containers started by a unit from podman generate systemd
+	systemdUnitLabel = "PODMAN_SYSTEMD_UNIT"
+)
 
 // Image configures targets to run a system prune periodically
 type Image struct {
@@ -26,8 +40,26 @@ type Image struct {
 	Url string `mapstructure:"url"`
 	// ImagePath defines the location of the image to import
 	ImagePath string `mapstructure:"imagePath"`
+	// Sha256 is the expected checksum of the image archive at Url
+	Sha256 string `mapstructure:"sha256"`
+	// Sha256Url is a sha256sum file holding the checksum of the image archive at Url
+	Sha256Url string `mapstructure:"sha256Url"`
+	// RestartContainers restarts the systemd units of containers using an image replaced by a new archive at Url
+	RestartContainers bool `mapstructure:"restartContainers"`
 	// Device is the device that the image is stored(USB)
 	Device string `mapstructure:"device"`
+	// References are images to pull from registries, by tag or pinned to a digest.
+	// Tags are pulled again when their digest changes
+	References []string `mapstructure:"references"`
+	// AuthFile is a registry auth file, as used by podman login, read from the fetchit container
+	AuthFile string `mapstructure:"authFile"`
+	// SignaturePolicy is a containers-policy.json, read from the fetchit container, that images
+	// must satisfy before they are pulled
+	SignaturePolicy string `mapstructure:"signaturePolicy"`
+	// CosignKey is a cosign public key, read from the fetchit container, that images must be signed with
+	CosignKey string `mapstructure:"cosignKey"`
+	// CosignImage is the image used to run cosign verify
+	CosignImage string `mapstructure:"cosignImage"`
 }
 
 func (i *Image) GetKind() string {
@@ -40,7 +72,13 @@ func (i *Image) Process(ctx, conn context.Context, PAT string, skew int) {
 	target.mu.Lock()
 	defer target.mu.Unlock()
 
-	if len(i.Url) > 0 {
+	if len(i.References) > 0 {
+		err := i.pullRegistryImages(ctx, conn)
+		if err != nil {
+			klog.Warningf("Method: %s, target: %s encountered error: %v", imageMethod, i.Name, err)
+		}
+		recordStatus(i, "", err)
+	} else if len(i.Url) > 0 {
 		err := i.loadHTTPPodman(ctx, conn, i.Url)
 		if err != nil {
 			klog.Warningf("Repository: %s Method: %s encountered error: %v, resetting...", target.url, imageMethod, err)
@@ -61,69 +99,307 @@ func (i *Image) Apply(ctx, conn context.Context, currentState, desiredState plum
 	return nil
 }
 
+// httpSource is what was last loaded from an Image's Url, used to detect a new archive at the same url
+type httpSource struct {
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"lastModified,omitempty"`
+	Sha256       string   `json:"sha256,omitempty"`
+	Images       []string `json:"images,omitempty"`
+}
+
 func (i *Image) loadHTTPPodman(ctx, conn context.Context, url string) error {
 	imageName := (path.Base(url))
 	pathToLoad := "/opt/" + imageName
-	data, err := http.Get(url)
+	cached, err := i.loadHTTPSource()
+	if err != nil {
+		return utils.WrapErr(err, "Error reading state of %s", url)
+	}
+	if _, err := os.Stat(pathToLoad); err != nil {
+		// the archive was removed, load it again
+		cached = nil
+	}
+	expected, err := i.expectedSHA256()
+	if err != nil {
+		return err
+	}
+	source, err := downloadFile(url, pathToLoad, expected, cached)
 	if err != nil {
-		// klog.Info("Failed to get image from url ", url) saving this for if we do various log levels
-		// remove the image if it exists
-		if _, err := os.Stat(pathToLoad); err != nil {
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			// klog.Info("Failed to get image from url ", url) saving this for if we do various log levels
 			klog.Info("URL not present...requeuing")
 			return nil
 		}
-		klog.Info("Flushing image from device ", pathToLoad)
-		flushImages(pathToLoad)
+		return err
+	}
+	if source == nil {
 		return nil
 	}
-	if data.StatusCode == http.StatusOK {
-		if _, err := os.Stat(pathToLoad); os.IsNotExist(err) {
-			klog.Infof("Loading image from %s", url)
-			// Place the data into the placeholder file
-			defer data.Body.Close()
+	if cached != nil && source.Sha256 == cached.Sha256 {
+		// the server sent the same archive again
+		source.Images = cached.Images
+		return i.saveHTTPSource(source)
+	}
 
-			// Fail early if http error code is not 200
-			if data.StatusCode != http.StatusOK {
-				klog.Error("Failed getting data from ", i.Url)
-				return err
-			}
-			// Create the file to write the data to
-			file, err := os.Create("/opt/" + imageName)
-			if err != nil {
-				klog.Error("Failed creating file ", file)
-				return err
-			}
-			// Write the data to the file
-			_, err = io.Copy(file, data.Body)
-			if err != nil {
-				klog.Error("Failed writing data to ", file)
-				return err
-			}
+	klog.Infof("Loading image from %s", url)
+	var previous map[string]string
+	if i.RestartContainers && cached != nil {
+		previous = imageIDs(conn, cached.Images)
+	}
+	source.Images, err = i.podmanImageLoad(ctx, conn, pathToLoad)
+	if err != nil {
+		klog.Error("Failed to load image from ", url)
+		return err
+	}
+	if err := i.saveHTTPSource(source); err != nil {
+		return err
+	}
+	if i.RestartContainers {
+		return i.restartContainers(conn, previous, imageIDs(conn, source.Images))
+	}
+	return nil
+}
 
-			err = i.podmanImageLoad(ctx, conn, pathToLoad)
-			if err != nil {
-				klog.Error("Failed to load image from device")
-				return err
+func (i *Image) loadHTTPSource() (*httpSource, error) {
+	b, err := os.ReadFile(filepath.Join(i.cacheDir(), "http.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	source := &httpSource{}
+	if err := json.Unmarshal(b, source); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (i *Image) saveHTTPSource(source *httpSource) error {
+	b, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(i.cacheDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(i.cacheDir(), "http.json"), b, 0600)
+}
+
+// imageIDs returns the ID of each image name that exists
+func imageIDs(conn context.Context, names []string) map[string]string {
+	ids := make(map[string]string)
+	for _, name := range names {
+		data, err := images.GetImage(conn, name, nil)
+		if err != nil {
+			continue
+		}
+		ids[name] = data.ID
+	}
+	return ids
+}
+
+// restartContainers restarts the containers running an image that was replaced. Containers must be
+// recreated to use the new image, so only containers managed by a systemd unit, which podman generate
+// systemd --new recreates on restart, are restarted.
+func (i *Image) restartContainers(conn context.Context, previous, current map[string]string) error {
+	units := make(map[string]struct{})
+	for name, oldID := range previous {
+		if current[name] == oldID {
+			continue
+		}
+		list, err := containers.List(conn, new(containers.ListOptions).WithFilters(map[string][]string{"ancestor": {oldID}}))
+		if err != nil {
+			return utils.WrapErr(err, "Error listing containers using %s", name)
+		}
+		for _, c := range list {
+			unit, ok := c.Labels[systemdUnitLabel]
+			if !ok {
+				klog.Warningf("Image target: %s, container %s uses the replaced image %s but is not managed by systemd, recreate it to use the new image", i.Name, c.Names, name)
+				continue
 			}
-			return nil
-		} else {
-			return nil
+			units[unit] = struct{}{}
+		}
+	}
+	for unit := range units {
+		klog.Infof("Image target: %s, restarting %s to use the new image", i.Name, unit)
+		h := &Hook{Unit: unit, Root: true, Action: hookRestart}
+		if _, err := h.run(conn, i.Name); err != nil {
+			return utils.WrapErr(err, "Error restarting %s", unit)
 		}
 	}
 	return nil
 }
 
+// expectedSHA256 returns the configured checksum of the image archive, fetching the sidecar file if one is set
+func (i *Image) expectedSHA256() (string, error) {
+	if i.Sha256 != "" || i.Sha256Url == "" {
+		return strings.ToLower(i.Sha256), nil
+	}
+	resp, err := http.Get(i.Sha256Url)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error fetching checksum from %s", i.Sha256Url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching checksum from %s returned %s", i.Sha256Url, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	// sha256sum output is "<sum>  <file name>"
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file %s is empty", i.Sha256Url)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// downloadFile streams url to dest through a .part file, resuming a previous partial download when the
+// server supports ranges and the archive has not changed since. dest only appears once the download is
+// complete and matches expectedSum, if set. If cached is set, the request is conditional and nil is
+// returned when the archive has not changed.
+func downloadFile(url, dest, expectedSum string, cached *httpSource) (*httpSource, error) {
+	part := dest + ".part"
+	h := sha256.New()
+	var offset int64
+	// a partial download is only resumed with If-Range, so a new archive at the url is
+	// downloaded whole instead of being appended to the old one
+	ifRange := partValidator(part)
+	if ifRange == "" {
+		removePart(part)
+	} else if f, err := os.Open(part); err == nil {
+		offset, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", ifRange)
+	} else if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	source := &httpSource{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return nil, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		klog.Infof("Resuming download of %s at %d bytes", url, offset)
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial download is already complete
+		return finishDownload(part, dest, h, expectedSum, source)
+	case resp.StatusCode == http.StatusOK:
+		h.Reset()
+		flags |= os.O_TRUNC
+		if err := savePartSource(part, source); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("downloading %s returned %s", url, resp.Status)
+	}
+	resumable := resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Accept-Ranges") == "bytes"
+
+	file, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error creating %s", part)
+	}
+	written, err := io.Copy(io.MultiWriter(file, h), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && resp.ContentLength >= 0 && written != resp.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", written, resp.ContentLength)
+	}
+	if err != nil {
+		if !resumable {
+			removePart(part)
+		}
+		return nil, utils.WrapErr(err, "Error downloading %s", url)
+	}
+	return finishDownload(part, dest, h, expectedSum, source)
+}
+
+// finishDownload moves a completed download into place if its checksum matches, removing it otherwise
+func finishDownload(part, dest string, h hash.Hash, expectedSum string, source *httpSource) (*httpSource, error) {
+	source.Sha256 = hex.EncodeToString(h.Sum(nil))
+	if expectedSum != "" && source.Sha256 != expectedSum {
+		removePart(part)
+		return nil, fmt.Errorf("checksum of %s is %s, expected %s", dest, source.Sha256, expectedSum)
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return nil, err
+	}
+	removePart(part)
+	return source, nil
+}
+
+// savePartSource keeps the validators of the response a partial download was started from next to it
+func savePartSource(part string, source *httpSource) error {
+	b, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(part+".json", b, 0644)
+}
+
+// partValidator returns the If-Range value to resume the partial download at part with: its strong
+// ETag, or its Last-Modified date. It is empty if the partial download cannot be resumed safely.
+func partValidator(part string) string {
+	b, err := os.ReadFile(part + ".json")
+	if err != nil {
+		return ""
+	}
+	source := &httpSource{}
+	if err := json.Unmarshal(b, source); err != nil {
+		return ""
+	}
+	// weak ETags may not be used with If-Range
+	if source.ETag != "" && !strings.HasPrefix(source.ETag, "W/") {
+		return source.ETag
+	}
+	return source.LastModified
+}
+
+// removePart removes a partial download and its validators
+func removePart(part string) {
+	os.Remove(part)
+	os.Remove(part + ".json")
+}
+
 func (i *Image) loadDevicePodman(ctx, conn context.Context) error {
 	// Define the path to the image
-	trimDir := filepath.Base(i.ImagePath)
 	baseDir := filepath.Dir(i.ImagePath)
 	pathToLoad := "/opt/" + i.ImagePath
-	_, exitCode, err := localDeviceCheck(baseDir, i.Device, trimDir)
+	present, err := localDeviceCheck(i.Device)
 	if err != nil {
 		klog.Error("Failed to check device")
 		return err
 	}
-	if exitCode != 0 {
+	if !present {
 		klog.Info("Device not present...requeuing")
 		// List files to see if anything needs to be flushed
 		if _, err := os.Stat(pathToLoad); err == nil {
@@ -131,50 +407,141 @@ func (i *Image) loadDevicePodman(ctx, conn context.Context) error {
 			flushImages(pathToLoad)
 		}
 		return nil
-	} else if exitCode == 0 {
-		// If file does not exist pull from the device
-		if _, err := os.Stat(pathToLoad); os.IsNotExist(err) {
-			id, err := localDevicePull(baseDir, i.Device, "-"+trimDir, true)
-			if err != nil {
-				klog.Info("Issue pulling image from device ", err)
-			}
-
-			// Wait for the image to be copied into the fetchit container
-			containers.Wait(conn, id, new(containers.WaitOptions).WithCondition([]define.ContainerStatus{stopped}))
-		}
-		err = i.podmanImageLoad(ctx, conn, pathToLoad)
-		if err != nil {
-			klog.Error("Failed to load image ", pathToLoad)
+	}
+	// If file does not exist pull from the device
+	if _, err := os.Stat(pathToLoad); os.IsNotExist(err) {
+		if err := localDevicePull(baseDir, i.Device, true); err != nil {
+			klog.Info("Issue pulling image from device ", err)
 			return err
 		}
-		return nil
+	}
+	_, err = i.podmanImageLoad(ctx, conn, pathToLoad)
+	if err != nil {
+		klog.Error("Failed to load image ", pathToLoad)
+		return err
 	}
 	return nil
 }
 
-func (i *Image) podmanImageLoad(ctx, conn context.Context, pathToLoad string) error {
+// podmanImageLoad loads the images at pathToLoad and returns the names of every loaded image.
+// docker-archive and oci-archive tarballs, compressed or not, and OCI layout directories are
+// accepted, and podman load moves the archive's tags to the loaded images.
+func (i *Image) podmanImageLoad(ctx, conn context.Context, pathToLoad string) ([]string, error) {
 	// Load image from path on the system using podman load
 	// Read the file that needs to be processed
-	klog.Infof("Loading image from %s", i.ImagePath)
-
-	file, err := os.Open(pathToLoad)
+	archive, format, err := openImageArchive(pathToLoad)
 	if err != nil {
 		klog.Error("Failed opening file ", pathToLoad)
-		return err
+		return nil, err
 	}
-	defer file.Close()
-	imported, err := images.Load(conn, file)
+	defer archive.Close()
+	klog.Infof("Loading image from %s (%s)", pathToLoad, format)
+
+	imported, err := images.Load(conn, archive)
 	if err != nil {
-		os.Remove(pathToLoad)
-		return err
+		flushImages(pathToLoad)
+		return nil, err
 	}
 
-	klog.Infof("Image %s loaded....Requeuing", imported.Names[0])
-	return nil
+	klog.Infof("Image %s loaded....Requeuing", strings.Join(imported.Names, ", "))
+	return imported.Names, nil
+}
+
+// openImageArchive returns a tar stream of the images at path, which podman load detects as a docker or
+// oci archive. Compressed archives are decompressed and OCI layout directories are archived on the fly.
+func openImageArchive(path string) (io.ReadCloser, string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "oci-layout")); err != nil {
+			return nil, "", fmt.Errorf("%s is a directory but not an OCI layout", path)
+		}
+		return tarDirectory(path), "oci layout", nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	algo, decompressor, reader, err := compression.DetectCompressionFormat(file)
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+	if decompressor == nil {
+		return &readCloser{Reader: reader, closers: []io.Closer{file}}, "tar", nil
+	}
+	decompressed, err := decompressor(reader)
+	if err != nil {
+		file.Close()
+		return nil, "", utils.WrapErr(err, "Error decompressing %s", path)
+	}
+	return &readCloser{Reader: decompressed, closers: []io.Closer{decompressed, file}}, algo.Name() + " compressed tar", nil
+}
+
+// readCloser closes every underlying reader of a stream
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// tarDirectory streams dir as a tar archive, which makes an OCI layout an oci-archive
+func tarDirectory(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			if !fi.Mode().IsRegular() && !fi.IsDir() {
+				return fmt.Errorf("unsupported file %s in OCI layout", p)
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
 }
 
 func flushImages(imagePath string) {
 	if _, err := os.Stat(imagePath); err == nil {
-		os.Remove(imagePath)
+		os.RemoveAll(imagePath)
 	}
 }
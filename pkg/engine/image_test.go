@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFile(t *testing.T) {
+	content := strings.Repeat("fetchit image archive\n", 1000)
+	sum := sha256.Sum256([]byte(content))
+	expected := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+expected[:16]+`"`)
+		http.ServeContent(w, r, "image.tar", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "image.tar")
+	// a previous interrupted download is resumed
+	if err := os.WriteFile(dest+".part", []byte(content[:100]), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := savePartSource(dest+".part", &httpSource{ETag: `"` + expected[:16] + `"`}); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	source, err := downloadFile(server.URL, dest, expected, nil)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if source.Sha256 != expected {
+		t.Fatalf("Failed: %s != %s", source.Sha256, expected)
+	}
+	// an unchanged archive is not downloaded again
+	source, err = downloadFile(server.URL, dest, expected, source)
+	if err != nil || source != nil {
+		t.Fatalf("Failed: expected not modified, got %+v, %v", source, err)
+	}
+
+	b, err := os.ReadFile(dest)
+	if err != nil || string(b) != content {
+		t.Fatalf("Failed: downloaded file does not match, %v", err)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("Failed: partial download left behind")
+	}
+
+	// a partial download of an archive since replaced at the url is not resumed
+	replaced := filepath.Join(dir, "replaced.tar")
+	if err := os.WriteFile(replaced+".part", []byte("previous archive"), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := savePartSource(replaced+".part", &httpSource{ETag: `"previous"`}); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if source, err := downloadFile(server.URL, replaced, "", nil); err != nil || source.Sha256 != expected {
+		t.Fatalf("Failed: replaced archive spliced onto the partial download, %+v, %v", source, err)
+	}
+	if _, err := os.Stat(replaced + ".part.json"); !os.IsNotExist(err) {
+		t.Fatalf("Failed: validators of the partial download left behind")
+	}
+
+	bad := filepath.Join(dir, "bad.tar")
+	if _, err := downloadFile(server.URL, bad, strings.Repeat("0", 64), nil); err == nil {
+		t.Fatalf("Failed: expected checksum error")
+	}
+	for _, p := range []string{bad, bad + ".part"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("Failed: %s left behind after checksum error", p)
+		}
+	}
+}
+
+func TestOpenImageArchive(t *testing.T) {
+	dir := t.TempDir()
+	layout := filepath.Join(dir, "layout")
+	if err := os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	for name, content := range map[string]string{
+		"oci-layout": `{"imageLayoutVersion": "1.0.0"}`,
+		"index.json": `{"schemaVersion": 2, "manifests": []}`,
+	} {
+		if err := os.WriteFile(filepath.Join(layout, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+	}
+
+	archive, format, err := openImageArchive(layout)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if format != "oci layout" {
+		t.Fatalf("Failed: unexpected format %s", format)
+	}
+	names := make(map[string]bool)
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		names[hdr.Name] = true
+	}
+	archive.Close()
+	for _, name := range []string{"oci-layout", "index.json", "blobs/sha256"} {
+		if !names[name] {
+			t.Fatalf("Failed: %s missing from archive %v", name, names)
+		}
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("docker archive"))
+	gz.Close()
+	compressed := filepath.Join(dir, "image.tar.gz")
+	if err := os.WriteFile(compressed, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	archive, format, err = openImageArchive(compressed)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	b, err := io.ReadAll(archive)
+	archive.Close()
+	if err != nil || string(b) != "docker archive" || format != "gzip compressed tar" {
+		t.Fatalf("Failed: unexpected %q (%s), %v", b, format, err)
+	}
+
+	if _, _, err := openImageArchive(dir); err == nil {
+		t.Fatalf("Failed: expected error for a directory that is not an OCI layout")
+	}
+}
@@ -27,6 +27,9 @@ import (
 
 const kubeMethod = "kube"
 
+// kubeFileTags are the suffixes of files the kube method deploys
+var kubeFileTags = []string{"yaml", "yml"}
+
 // Kube to launch pods using podman kube-play
 type Kube struct {
 	CommonMethod `mapstructure:",squash"`
@@ -43,7 +46,7 @@ func (k *Kube) Process(ctx, conn context.Context, PAT string, skew int) {
 	defer target.mu.Unlock()
 
 	initial := k.initialRun
-	tag := []string{"yaml", "yml"}
+	tag := kubeFileTags
 	if initial {
 		err := getRepo(target, PAT)
 		if err != nil {
@@ -58,7 +61,7 @@ func (k *Kube) Process(ctx, conn context.Context, PAT string, skew int) {
 		}
 	}
 
-	err := currentToLatest(ctx, conn, k, target, &tag)
+	err := currentToLatest(ctx, conn, k, target, PAT, &tag)
 	if err != nil {
 		klog.Errorf("Error moving current to latest: %v", err)
 		return
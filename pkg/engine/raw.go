@@ -21,6 +21,9 @@ import (
 
 const rawMethod = "raw"
 
+// rawFileTags are the suffixes of files the raw method deploys
+var rawFileTags = []string{".json", ".yaml", ".yml"}
+
 // Raw to deploy pods from json or yaml files
 type Raw struct {
 	CommonMethod `mapstructure:",squash"`
@@ -85,7 +88,7 @@ func (r *Raw) Process(ctx context.Context, conn context.Context, PAT string, ske
 	target.mu.Lock()
 	defer target.mu.Unlock()
 
-	tag := []string{".json", ".yaml", ".yml"}
+	tag := rawFileTags
 
 	if r.initialRun {
 		err := getRepo(target, PAT)
@@ -101,7 +104,7 @@ func (r *Raw) Process(ctx context.Context, conn context.Context, PAT string, ske
 		}
 	}
 
-	err := currentToLatest(ctx, conn, r, target, &tag)
+	err := currentToLatest(ctx, conn, r, target, PAT, &tag)
 	if err != nil {
 		klog.Errorf("Error moving current to latest: %v", err)
 		return
@@ -0,0 +1,296 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/containers/podman/v4/pkg/specgen"
+	digest "github.com/opencontainers/go-digest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultCosignImage = "gcr.io/projectsigstore/cosign:v1.13.1"
+	cosignKeyEnv       = "COSIGN_PUBLIC_KEY"
+)
+
+// imageReference is an image to pull from a registry, by tag or pinned to a digest
+type imageReference struct {
+	// Named is the repository, e.g. quay.io/fetchit/fetchit
+	Named reference.Named
+	// Tag is empty when the reference is pinned to a digest
+	Tag string
+	// Digest is the pinned digest, or the digest the tag resolved to
+	Digest digest.Digest
+}
+
+// parseImageReference normalizes ref, defaulting to the latest tag when neither a tag nor a digest is given
+func parseImageReference(ref string) (*imageReference, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Invalid image reference %s", ref)
+	}
+	named = reference.TagNameOnly(named)
+	r := &imageReference{Named: reference.TrimNamed(named)}
+	if digested, ok := named.(reference.Digested); ok {
+		r.Digest = digested.Digest()
+		return r, nil
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		r.Tag = tagged.Tag()
+	}
+	return r, nil
+}
+
+// String is the reference as configured, by tag or by digest
+func (r *imageReference) String() string {
+	if r.Tag != "" {
+		return r.Named.String() + ":" + r.Tag
+	}
+	return r.pinned()
+}
+
+// pinned is the reference by digest, which is what is verified and pulled
+func (r *imageReference) pinned() string {
+	return r.Named.String() + "@" + r.Digest.String()
+}
+
+func (i *Image) systemContext() *types.SystemContext {
+	return &types.SystemContext{AuthFilePath: i.AuthFile}
+}
+
+// pullRegistryImages pulls every configured reference whose digest is not yet present,
+// verifying signatures first. Tags are resolved to digests on every run, so a moved tag is
+// pulled again.
+func (i *Image) pullRegistryImages(ctx, conn context.Context) error {
+	digests, err := i.loadDigests()
+	if err != nil {
+		return utils.WrapErr(err, "Error reading pulled image digests")
+	}
+	var errs []string
+	for _, ref := range i.References {
+		if err := i.pullRegistryImage(ctx, conn, ref, digests); err != nil {
+			klog.Errorf("Image target: %s, %v", i.Name, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := i.saveDigests(digests); err != nil {
+		return utils.WrapErr(err, "Error saving pulled image digests")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (i *Image) pullRegistryImage(ctx, conn context.Context, ref string, digests map[string]string) error {
+	r, err := parseImageReference(ref)
+	if err != nil {
+		return err
+	}
+	if r.Tag != "" {
+		tagged, err := reference.WithTag(r.Named, r.Tag)
+		if err != nil {
+			return err
+		}
+		imageRef, err := docker.NewReference(tagged)
+		if err != nil {
+			return err
+		}
+		r.Digest, err = docker.GetDigest(ctx, i.systemContext(), imageRef)
+		if err != nil {
+			return utils.WrapErr(err, "Error resolving digest of %s", r)
+		}
+	}
+
+	present, err := images.Exists(conn, r.pinned(), nil)
+	if err != nil {
+		return err
+	}
+	if present && digests[r.String()] == r.Digest.String() {
+		return nil
+	}
+
+	if err := i.verifyImage(ctx, conn, r); err != nil {
+		return err
+	}
+	klog.Infof("Image target: %s, pulling %s", i.Name, r.pinned())
+	if _, err := images.Pull(conn, r.pinned(), new(images.PullOptions).WithAuthfile(i.AuthFile).WithQuiet(true)); err != nil {
+		return utils.WrapErr(err, "Error pulling %s", r.pinned())
+	}
+	if r.Tag != "" {
+		// images pulled by digest are untagged, tag them so containers can refer to the tag
+		if err := images.Tag(conn, r.pinned(), r.Tag, r.Named.String(), nil); err != nil {
+			return utils.WrapErr(err, "Error tagging %s as %s", r.pinned(), r)
+		}
+	}
+	if prev, ok := digests[r.String()]; ok && prev != r.Digest.String() {
+		klog.Infof("Image target: %s, %s moved from %s to %s", i.Name, r, prev, r.Digest)
+	}
+	digests[r.String()] = r.Digest.String()
+	return nil
+}
+
+// verifyImage checks the image at its pinned digest against the signature policy and cosign key, if set.
+// Nothing is pulled until verification succeeds.
+func (i *Image) verifyImage(ctx, conn context.Context, r *imageReference) error {
+	if i.SignaturePolicy == "" && i.CosignKey == "" {
+		return nil
+	}
+	if i.SignaturePolicy != "" {
+		if err := i.verifyPolicy(ctx, r); err != nil {
+			return utils.WrapErr(err, "Image %s rejected by signature policy %s", r.pinned(), i.SignaturePolicy)
+		}
+	}
+	if i.CosignKey != "" {
+		if err := i.verifyCosign(conn, r); err != nil {
+			return utils.WrapErr(err, "Image %s failed cosign verification", r.pinned())
+		}
+	}
+	klog.Infof("Image target: %s, verified signatures of %s", i.Name, r.pinned())
+	return nil
+}
+
+// verifyPolicy evaluates a containers-policy.json against the image in the registry
+func (i *Image) verifyPolicy(ctx context.Context, r *imageReference) error {
+	policy, err := signature.NewPolicyFromFile(i.SignaturePolicy)
+	if err != nil {
+		return err
+	}
+	pc, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return err
+	}
+	defer pc.Destroy()
+
+	named, err := reference.WithDigest(r.Named, r.Digest)
+	if err != nil {
+		return err
+	}
+	imageRef, err := docker.NewReference(named)
+	if err != nil {
+		return err
+	}
+	src, err := imageRef.NewImageSource(ctx, i.systemContext())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	allowed, err := pc.IsRunningImageAllowed(ctx, image.UnparsedInstance(src, nil))
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("image not allowed")
+	}
+	return nil
+}
+
+// verifyCosign runs cosign verify against the pinned digest in a helper container. The key
+// is passed in the environment and registry credentials through the fetchit volume.
+func (i *Image) verifyCosign(conn context.Context, r *imageReference) error {
+	key, err := os.ReadFile(i.CosignKey)
+	if err != nil {
+		return utils.WrapErr(err, "Error reading cosign key %s", i.CosignKey)
+	}
+	cosignImage := i.CosignImage
+	if cosignImage == "" {
+		cosignImage = defaultCosignImage
+	}
+	if err := detectOrFetchImage(conn, cosignImage, false); err != nil {
+		return err
+	}
+
+	s := specgen.NewSpecGenerator(cosignImage, false)
+	s.Name = "cosign-" + i.Name
+	s.Command = []string{"verify", "--key", "env://" + cosignKeyEnv, r.pinned()}
+	s.Env = map[string]string{cosignKeyEnv: string(key)}
+	s.NetNS = specgen.Namespace{
+		NSMode: "host",
+		Value:  "",
+	}
+	if i.AuthFile != "" {
+		dockerConfig, err := i.cosignDockerConfig()
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dockerConfig)
+		s.Volumes = []*specgen.NamedVolume{{Name: fetchitVolume, Dest: "/opt", Options: []string{"ro"}}}
+		s.Env["DOCKER_CONFIG"] = dockerConfig
+	}
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return err
+	}
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("cosign exited with %d: %s", exitCode, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// cosignDockerConfig copies the auth file into a temporary docker config directory for cosign,
+// in the fetchit volume so the cosign container can read it. The caller removes the directory.
+func (i *Image) cosignDockerConfig() (string, error) {
+	b, err := os.ReadFile(i.AuthFile)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error reading auth file %s", i.AuthFile)
+	}
+	if err := os.MkdirAll(i.cacheDir(), 0700); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(i.cacheDir(), "docker-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), b, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (i *Image) cacheDir() string {
+	return filepath.Join("/opt", ".cache", imageMethod, i.Name)
+}
+
+// loadDigests returns the digest last pulled for each reference
+func (i *Image) loadDigests() (map[string]string, error) {
+	digests := make(map[string]string)
+	b, err := os.ReadFile(filepath.Join(i.cacheDir(), "digests.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return digests, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &digests); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+func (i *Image) saveDigests(digests map[string]string) error {
+	b, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(i.cacheDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(i.cacheDir(), "digests.json"), b, 0600)
+}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := map[string]string{
+		"quay.io/fetchit/fetchit:v0.1": "quay.io/fetchit/fetchit:v0.1",
+		"nginx":                        "docker.io/library/nginx:latest",
+		"quay.io/fetchit/fetchit@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": "quay.io/fetchit/fetchit@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	for ref, expected := range tests {
+		r, err := parseImageReference(ref)
+		if err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		if r.String() != expected {
+			t.Fatalf("Failed: %s != %s", r, expected)
+		}
+	}
+
+	r, err := parseImageReference("quay.io/fetchit/fetchit@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if r.Tag != "" || r.Digest == "" {
+		t.Fatalf("Failed: digest reference should be pinned, got %+v", r)
+	}
+
+	if _, err := parseImageReference("Invalid/Reference"); err == nil {
+		t.Fatalf("Failed: expected error for invalid reference")
+	}
+}
@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	"github.com/go-co-op/gocron"
+	"k8s.io/klog/v2"
+)
+
+// scheduledMethod is a method in the scheduler and the settings it was scheduled with
+type scheduledMethod struct {
+	method Method
+	sched  SchedInfo
+	job    *gocron.Job
+	// fingerprint is the checksum of the settings of the method and its target
+	fingerprint string
+	// cancel stops runs of the method that have not started yet
+	cancel context.CancelFunc
+}
+
+// targetSettings are the settings of a target that methods depend on
+type targetSettings struct {
+	Name         string                 `json:"name"`
+	Url          string                 `json:"url"`
+	Device       string                 `json:"device"`
+	Branch       string                 `json:"branch"`
+	Disconnected bool                   `json:"disconnected"`
+	Bundle       *Bundle                `json:"bundle"`
+	Vars         map[string]interface{} `json:"vars"`
+}
+
+func (t *Target) settings() targetSettings {
+	return targetSettings{
+		Name:         t.name,
+		Url:          t.url,
+		Device:       t.device,
+		Branch:       t.branch,
+		Disconnected: t.disconnected,
+		Bundle:       t.bundle,
+		Vars:         t.vars,
+	}
+}
+
+// id identifies a target across config reloads, by its name or by where it is fetched from, as
+// targets are identified when configs are merged. The targets fetchit adds for configReload, prune,
+// images and podmanAutoUpdate have no repository and no id.
+func (t *Target) id() string {
+	if t.url == "" && t.device == "" {
+		return ""
+	}
+	if t.name != "" {
+		return t.name
+	}
+	return t.url + t.device + "@" + t.branch
+}
+
+// reuseTarget returns the target of the previous config with the same id and settings, so methods
+// added to a running target share its lock and never run alongside its other methods
+func (f *Fetchit) reuseTarget(t *Target, previous *Fetchit) *Target {
+	id := t.id()
+	if id == "" {
+		return t
+	}
+	if previous != nil {
+		if old, ok := previous.targets[id]; ok && fingerprint(old.settings()) == fingerprint(t.settings()) {
+			t = old
+		}
+	}
+	f.targets[id] = t
+	return t
+}
+
+// methodKey identifies a method across config reloads
+func methodKey(m Method) string {
+	if id := m.GetTarget().id(); id != "" {
+		return fmt.Sprintf("%s/%s/%s", id, m.GetKind(), m.GetName())
+	}
+	return fmt.Sprintf("%s/%s", m.GetKind(), m.GetName())
+}
+
+// methodFingerprint is the checksum of everything a method is scheduled with: its settings, which
+// include its schedule, its target's and the PAT
+func methodFingerprint(m Method, PAT string) string {
+	return fingerprint(struct {
+		Target targetSettings `json:"target"`
+		Method Method         `json:"method"`
+		PAT    string         `json:"pat"`
+	}{m.GetTarget().settings(), m, PAT})
+}
+
+// fingerprint is the checksum of v, or empty if v cannot be encoded, so it never matches
+func fingerprint(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		klog.Warningf("Unable to compare settings, treating them as changed: %v", err)
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// schedule adds a method to the scheduler, starting it immediately
+func (f *Fetchit) schedule(method Method, sched SchedInfo) error {
+	skew := 0
+	if sched.skew != nil {
+		skew = rand.Intn(*sched.skew)
+	}
+	// taken before the first run, as Process may change the method's settings, e.g. systemd enables
+	// a unit that is restarted, and must not race with it
+	sum := methodFingerprint(method, f.pat)
+	ctx, cancel := context.WithCancel(context.Background())
+	klog.Infof("Processing git target: %s Method: %s Name: %s", method.GetTarget().url, method.GetKind(), method.GetName())
+	job, err := f.scheduler.Cron(sched.schedule).Tag(method.GetKind()).StartImmediately().Do(runMethod, ctx, f.conn, method, f.pat, skew)
+	if err != nil {
+		cancel()
+		return err
+	}
+	f.scheduled[methodKey(method)] = &scheduledMethod{
+		method:      method,
+		sched:       sched,
+		job:         job,
+		fingerprint: sum,
+		cancel:      cancel,
+	}
+	return nil
+}
+
+// runMethod runs a scheduled method, unless a reload stopped it while the run was queued
+func runMethod(ctx, conn context.Context, method Method, PAT string, skew int) {
+	if ctx.Err() != nil {
+		return
+	}
+	method.Process(ctx, conn, PAT, skew)
+}
+
+// unschedule removes a method from the scheduler, waiting under the target's lock for a run in
+// progress to finish
+func (f *Fetchit) unschedule(sm *scheduledMethod) {
+	target := sm.method.GetTarget()
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if sm.job != nil {
+		f.scheduler.RemoveByReference(sm.job)
+	}
+	sm.cancel()
+}
+
+// reschedule takes over the methods previous scheduled for the config f was built from. Methods
+// whose settings did not change keep running untouched, removed and changed methods are stopped
+// once their current run finishes, and new and changed methods are scheduled.
+func (f *Fetchit) reschedule(previous *Fetchit) {
+	desired := make(map[string]Method)
+	for method := range f.methodTargetScheds {
+		desired[methodKey(method)] = method
+	}
+	var added, updated, removed, unchanged int
+	for key, sm := range previous.scheduled {
+		method, ok := desired[key]
+		if ok && sm.fingerprint != "" && sm.fingerprint == methodFingerprint(method, f.pat) {
+			f.scheduled[key] = sm
+			// the running method replaces the one built from the new config
+			delete(f.methodTargetScheds, method)
+			f.methodTargetScheds[sm.method] = sm.sched
+			unchanged++
+			continue
+		}
+		previous.unschedule(sm)
+		if ok {
+			klog.Infof("Config of %s changed, restarting it", key)
+			updated++
+		} else {
+			klog.Infof("%s was removed from the config, stopping it", key)
+			removed++
+		}
+	}
+	for key, method := range desired {
+		if _, ok := f.scheduled[key]; ok {
+			continue
+		}
+		if _, ok := previous.scheduled[key]; !ok {
+			added++
+		}
+		if err := f.schedule(method, f.methodTargetScheds[method]); err != nil {
+			klog.Errorf("Error scheduling %s: %v", key, err)
+		}
+	}
+	klog.Infof("Config reloaded: %d methods added, %d updated, %d removed, %d unchanged", added, updated, removed, unchanged)
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+type testMethod struct {
+	CommonMethod `mapstructure:",squash"`
+	Enable       bool `mapstructure:"enable"`
+	processed    chan struct{}
+}
+
+func (m *testMethod) GetKind() string {
+	return "test"
+}
+
+func (m *testMethod) Process(ctx, conn context.Context, PAT string, skew int) {
+	if m.processed != nil {
+		// as systemd enables units that are restarted
+		m.Enable = true
+		close(m.processed)
+	}
+}
+
+func (m *testMethod) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
+	return nil
+}
+
+func (m *testMethod) MethodEngine(ctx, conn context.Context, change *object.Change, path string) error {
+	return nil
+}
+
+func testFetchit(scheduler *gocron.Scheduler, previous *Fetchit, methods map[string]string) *Fetchit {
+	f := newFetchit()
+	f.scheduler = scheduler
+	target := f.reuseTarget(&Target{url: "https://github.com/containers/fetchit", branch: "main"}, previous)
+	for name, schedule := range methods {
+		m := &testMethod{CommonMethod: CommonMethod{Name: name, Schedule: schedule, target: target}}
+		f.methodTargetScheds[m] = m.SchedInfo()
+	}
+	return f
+}
+
+func TestReschedule(t *testing.T) {
+	scheduler := gocron.NewScheduler(time.UTC)
+	previous := testFetchit(scheduler, nil, map[string]string{
+		"same":    "*/1 * * * *",
+		"changed": "*/1 * * * *",
+		"removed": "*/1 * * * *",
+	})
+	for method, sched := range previous.methodTargetScheds {
+		if err := previous.schedule(method, sched); err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+	}
+
+	next := testFetchit(scheduler, previous, map[string]string{
+		"same":    "*/1 * * * *",
+		"changed": "*/5 * * * *",
+		"added":   "*/1 * * * *",
+	})
+	target := previous.targets["https://github.com/containers/fetchit@main"]
+	if target == nil || next.targets["https://github.com/containers/fetchit@main"] != target {
+		t.Fatalf("Failed: unchanged target was not reused")
+	}
+	next.reschedule(previous)
+
+	key := func(name string) string {
+		return "https://github.com/containers/fetchit@main/test/" + name
+	}
+	if next.scheduled[key("same")] != previous.scheduled[key("same")] {
+		t.Errorf("Failed: unchanged method was rescheduled")
+	}
+	if sm := next.scheduled[key("changed")]; sm == nil || sm == previous.scheduled[key("changed")] || sm.sched.schedule != "*/5 * * * *" {
+		t.Errorf("Failed: changed method was not rescheduled")
+	}
+	if next.scheduled[key("added")] == nil {
+		t.Errorf("Failed: added method was not scheduled")
+	}
+	if next.scheduled[key("removed")] != nil {
+		t.Errorf("Failed: removed method is still scheduled")
+	}
+	if len(scheduler.Jobs()) != 3 || len(next.methodTargetScheds) != 3 {
+		t.Errorf("Failed: expected 3 jobs, got %d", len(scheduler.Jobs()))
+	}
+}
+
+func TestScheduleFingerprint(t *testing.T) {
+	scheduler := gocron.NewScheduler(time.UTC)
+	scheduler.StartAsync()
+	defer scheduler.Stop()
+	f := testFetchit(scheduler, nil, nil)
+	f.conn = context.Background()
+	m := &testMethod{CommonMethod: CommonMethod{Name: "enable", Schedule: "*/1 * * * *", target: &Target{}}, processed: make(chan struct{})}
+	configured := methodFingerprint(&testMethod{CommonMethod: m.CommonMethod}, f.pat)
+	if err := f.schedule(m, m.SchedInfo()); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	select {
+	case <-m.processed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed: method did not run")
+	}
+	if f.scheduled["test/enable"].fingerprint != configured {
+		t.Fatalf("Failed: fingerprint includes settings changed by the first run")
+	}
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+var statusDir = filepath.Join("/opt", ".cache", "status")
+
+// MethodStatus is the outcome of the most recent run of a method
+type MethodStatus struct {
+	Kind    string      `json:"kind"`
+	Name    string      `json:"name"`
+	Target  string      `json:"target,omitempty"`
+	Commit  string      `json:"commit,omitempty"`
+	Time    time.Time   `json:"time"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// statusDetailer is implemented by methods that report more than
+// success or failure with their status, e.g. systemd unit health
+type statusDetailer interface {
+	statusDetails() interface{}
+}
+
+func statusKey(kind, name string) string {
+	return fmt.Sprintf("%s-%s", kind, name)
+}
+
+// recordStatus writes the result of a method run to /opt/.cache/status/<kind>-<name>.json for inspection
+func recordStatus(m Method, commit string, runErr error) {
+	status := &MethodStatus{
+		Kind:    m.GetKind(),
+		Name:    m.GetName(),
+		Commit:  commit,
+		Time:    time.Now().UTC(),
+		Success: runErr == nil,
+	}
+	if target := m.GetTarget(); target != nil {
+		status.Target = target.url
+	}
+	if runErr != nil {
+		status.Error = runErr.Error()
+	}
+	if d, ok := m.(statusDetailer); ok {
+		status.Details = d.statusDetails()
+	}
+
+	key := statusKey(status.Kind, status.Name)
+
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		klog.Warningf("Unable to marshal status of %s: %v", key, err)
+		return
+	}
+	if err := os.MkdirAll(statusDir, 0755); err != nil {
+		klog.Warningf("Unable to create status directory %s: %v", statusDir, err)
+		return
+	}
+	b = []byte(logRedactor.redact(string(b)))
+	if err := os.WriteFile(filepath.Join(statusDir, key+".json"), b, 0644); err != nil {
+		klog.Warningf("Unable to write status of %s: %v", key, err)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/containers/fetchit/pkg/engine/utils"
@@ -26,8 +28,17 @@ const (
 	systemdPathRoot         = "/etc/systemd/system"
 	systemdMethod           = "systemd"
 	systemdImage            = "quay.io/fetchit/fetchit-systemd-amd:latest"
+	systemdRollbackDir      = ".cache/systemd-rollback"
+	defaultJournalLines     = 10
+	journalMarker           = "JOURNAL:"
 )
 
+// systemdFileTags are the suffixes of files the systemd method deploys
+var systemdFileTags = []string{".service"}
+
+// systemdInstancesDir holds the instances fetchit enabled for each template unit, by method
+var systemdInstancesDir = "/opt/.cache/systemd-instances"
+
 // Systemd to place and/or enable systemd unit files on host
 type Systemd struct {
 	CommonMethod `mapstructure:",squash"`
@@ -40,8 +51,89 @@ type Systemd struct {
 	Restart bool `mapstructure:"restart"`
 	// If true, will enable and start systemd services from fetched unit files
 	// If false (default), will place unit file(s) in appropriate systemd path
-	Enable        bool `mapstructure:"enable"`
+	Enable bool `mapstructure:"enable"`
+	// Number of journal lines to collect for each unit after enable or restart
+	// Defaults to 10
+	JournalLines *int `mapstructure:"journalLines"`
+	// If true, a unit that fails after a changed unit file was placed will be
+	// returned to the previous unit file and enabled or restarted again
+	Rollback bool `mapstructure:"rollback"`
+	// User is the name or UID of a host user whose session will manage the units
+	// Unit files are placed in that user's ~/.config/systemd/user/, Root must be false
+	User string `mapstructure:"user"`
+	// If true, enables linger for User so that their units run without a login session
+	Linger bool `mapstructure:"linger"`
+	// Instances to enable for each template unit file (name@.service) in the target path
+	// Numeric ranges such as 1..8 are expanded
+	Instances []string `mapstructure:"instances"`
+	// Path in the git repository to a file listing template instances, one per line
+	// Combined with Instances, changes to this file start or stop only the difference
+	InstancesFile string `mapstructure:"instancesFile"`
 	autoUpdateAll bool
+	// hostUser is resolved from User on the host
+	hostUser      *hostUser
+	lingerEnabled bool
+	// unitDirReady is set once the unit directory of hostUser exists
+	unitDirReady bool
+	// unitStatus holds the health of each unit from the most recent action
+	unitStatus map[string]*UnitStatus
+	// systemctl runs an action against an instance of a template unit, enableRestartSystemdService
+	// unless replaced
+	systemctl func(conn context.Context, action, dest, service string) error
+}
+
+// UnitStatus is the state of a systemd unit after fetchit acted on it
+type UnitStatus struct {
+	Unit        string   `json:"unit"`
+	ActiveState string   `json:"activeState"`
+	SubState    string   `json:"subState"`
+	Result      string   `json:"result"`
+	Journal     []string `json:"journal,omitempty"`
+}
+
+// Failed is true if the unit did not reach a healthy state
+func (u *UnitStatus) Failed() bool {
+	if u.ActiveState == "failed" {
+		return true
+	}
+	return u.Result != "" && u.Result != "success"
+}
+
+func (u *UnitStatus) String() string {
+	return fmt.Sprintf("%s: ActiveState=%s SubState=%s Result=%s", u.Unit, u.ActiveState, u.SubState, u.Result)
+}
+
+// parseUnitStatus reads the output of the systemd method container,
+// systemctl show properties followed by the journal of the unit
+func parseUnitStatus(unit, output string) *UnitStatus {
+	status := &UnitStatus{Unit: unit}
+	inJournal := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if inJournal {
+			if line != "" {
+				status.Journal = append(status.Journal, line)
+			}
+			continue
+		}
+		if line == journalMarker {
+			inJournal = true
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ActiveState":
+			status.ActiveState = kv[1]
+		case "SubState":
+			status.SubState = kv[1]
+		case "Result":
+			status.Result = kv[1]
+		}
+	}
+	return status
 }
 
 type PodmanAutoUpdate struct {
@@ -96,7 +188,7 @@ func (sd *Systemd) Process(ctx, conn context.Context, PAT string, skew int) {
 	if sd.autoUpdateAll && !sd.initialRun {
 		return
 	}
-	tag := []string{".service"}
+	tag := systemdFileTags
 	if sd.Restart {
 		sd.Enable = true
 	}
@@ -121,50 +213,109 @@ func (sd *Systemd) Process(ctx, conn context.Context, PAT string, skew int) {
 		}
 	}
 
-	err := currentToLatest(ctx, conn, sd, target, &tag)
+	err := currentToLatest(ctx, conn, sd, target, PAT, &tag)
 	if err != nil {
 		klog.Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
+	if err := sd.reconcileInstances(conn); err != nil {
+		klog.Errorf("Error reconciling template instances: %v", err)
+		return
+	}
+
 	sd.initialRun = false
 }
 
+func (sd *Systemd) statusDetails() interface{} {
+	return sd.unitStatus
+}
+
 func (sd *Systemd) MethodEngine(ctx context.Context, conn context.Context, change *object.Change, path string) error {
-	var prev *string = nil
+	prev := changedName(change, path)
+	// keep the previous unit file contents in case the new one must be rolled back
+	var prevUnit *string
+	if sd.Rollback && change != nil && change.From.Name != "" && path != deleteFile {
+		var err error
+		prevUnit, err = getChangeString(change)
+		if err != nil {
+			return err
+		}
+	}
+	dest, err := sd.unitDir(conn)
+	if err != nil {
+		return err
+	}
 	if change != nil {
-		if change.To.Name != "" {
-			prev = &change.To.Name
+		sd.initialRun = true
+	}
+	return sd.systemdPodman(ctx, conn, path, dest, prev, prevUnit)
+}
+
+// unitDir returns the directory unit files are placed in on the host
+func (sd *Systemd) unitDir(conn context.Context) (string, error) {
+	if sd.Root {
+		return systemdPathRoot, nil
+	}
+	nonRootHomeDir, err := sd.homeDir(conn)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(nonRootHomeDir, ".config", "systemd", "user"), nil
+}
+
+// homeDir returns the home directory of the user whose session manages the units
+func (sd *Systemd) homeDir(conn context.Context) (string, error) {
+	if sd.User != "" {
+		u, err := sd.resolveUser(conn)
+		if err != nil {
+			return "", err
 		}
+		return u.Home, nil
 	}
 	nonRootHomeDir := os.Getenv("HOME")
 	if nonRootHomeDir == "" {
-		return fmt.Errorf("Could not determine $HOME for host, must set $HOME on host machine for non-root systemd method")
+		return "", fmt.Errorf("Could not determine $HOME for host, must set $HOME on host machine for non-root systemd method")
 	}
-	var dest string
-	if sd.Root {
-		dest = systemdPathRoot
-	} else {
-		dest = filepath.Join(nonRootHomeDir, ".config", "systemd", "user")
+	return nonRootHomeDir, nil
+}
+
+// resolveUser looks up User on the host once and enables linger if requested
+func (sd *Systemd) resolveUser(conn context.Context) (*hostUser, error) {
+	if sd.hostUser == nil {
+		if sd.Root {
+			return nil, fmt.Errorf("Systemd target %s sets both root and user %s", sd.Name, sd.User)
+		}
+		u, err := lookupHostUser(conn, sd.User)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error resolving user %s for systemd target %s", sd.User, sd.Name)
+		}
+		klog.Infof("Systemd target: %s, managing units for user %s (uid %d, home %s, runtime dir %s)", sd.Name, u.Name, u.UID, u.Home, u.RuntimeDir)
+		sd.hostUser = u
 	}
-	if change != nil {
-		sd.initialRun = true
+	if sd.Linger && !sd.lingerEnabled {
+		if err := sd.enableLinger(conn); err != nil {
+			return nil, utils.WrapErr(err, "Error enabling linger for user %s", sd.hostUser.Name)
+		}
+		sd.lingerEnabled = true
 	}
-	return sd.systemdPodman(ctx, conn, path, dest, prev)
+	return sd.hostUser, nil
 }
 
 func (sd *Systemd) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
+	sd.unitStatus = make(map[string]*UnitStatus)
 	changeMap, err := applyChanges(ctx, sd.GetTarget(), sd.GetTargetPath(), sd.Glob, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
+	sd.skipInstancesFile(changeMap)
 	if err := runChanges(ctx, conn, sd, changeMap); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (sd *Systemd) systemdPodman(ctx context.Context, conn context.Context, path, dest string, prev *string) error {
+func (sd *Systemd) systemdPodman(ctx context.Context, conn context.Context, path, dest string, prev, prevUnit *string) error {
 	klog.Infof("Deploying systemd file(s) %s", path)
 	if sd.autoUpdateAll {
 		if !sd.initialRun {
@@ -175,29 +326,111 @@ func (sd *Systemd) systemdPodman(ctx context.Context, conn context.Context, path
 		}
 		return sd.enableRestartSystemdService(conn, "autoupdate", dest, podmanAutoUpdateService)
 	}
+	if path == deleteFile && prev != nil && isTemplateUnit(filepath.Base(*prev)) {
+		// instances are disabled while their template still exists
+		if err := sd.removeInstances(conn, dest, filepath.Base(*prev)); err != nil {
+			return err
+		}
+	}
 	if sd.initialRun {
-		ft := &FileTransfer{
-			CommonMethod: CommonMethod{
-				Name: sd.Name,
-			},
+		ft, err := sd.fileTransfer(conn, dest)
+		if err != nil {
+			return err
 		}
 		if err := ft.fileTransferPodman(ctx, conn, path, dest, prev); err != nil {
 			return utils.WrapErr(err, "Error deploying systemd %s file(s), Path: %s", sd.Name, sd.TargetPath)
 		}
 	}
+	if path == deleteFile {
+		return nil
+	}
 	if !sd.Enable {
 		klog.Infof("Systemd target %s successfully processed", sd.Name)
 		return nil
 	}
+	action := sd.unitAction()
+	if action == "" {
+		return nil
+	}
+	err := sd.runUnitAction(conn, action, dest, filepath.Base(path))
+	if err == nil || prevUnit == nil {
+		return err
+	}
+	if rbErr := sd.rollbackUnit(ctx, conn, path, dest, action, *prevUnit); rbErr != nil {
+		return utils.WrapErr(err, "Error rolling back systemd unit %s: %v", filepath.Base(path), rbErr)
+	}
+	return utils.WrapErr(err, "Systemd unit %s rolled back to previous unit file", filepath.Base(path))
+}
+
+// fileTransfer returns the method placing unit files in dest. The unit files of a host user are
+// owned by that user, as are the directories created for them below the user's home.
+func (sd *Systemd) fileTransfer(conn context.Context, dest string) (*FileTransfer, error) {
+	ft := &FileTransfer{
+		CommonMethod: CommonMethod{
+			Name: sd.Name,
+		},
+	}
+	if sd.hostUser == nil {
+		return ft, nil
+	}
+	ft.Owner = strconv.Itoa(sd.hostUser.UID)
+	ft.Group = strconv.Itoa(sd.hostUser.GID)
+	if !sd.unitDirReady {
+		script, err := userDirScript(sd.hostUser, dest)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := runHostCommand(conn, "systemd-unit-dir-"+sd.hostUser.Name+"-"+sd.Name, script); err != nil {
+			return nil, utils.WrapErr(err, "Error creating %s for user %s", dest, sd.hostUser.Name)
+		}
+		sd.unitDirReady = true
+	}
+	return ft, nil
+}
+
+// unitAction returns the systemctl action to run for a placed unit file
+func (sd *Systemd) unitAction() string {
 	if (sd.Enable && !sd.Restart) || sd.initialRun {
 		if sd.Enable {
-			return sd.enableRestartSystemdService(conn, "enable", dest, filepath.Base(path))
+			return "enable"
 		}
 	}
 	if sd.Restart {
-		return sd.enableRestartSystemdService(conn, "restart", dest, filepath.Base(path))
+		return "restart"
 	}
-	return nil
+	return ""
+}
+
+// rollbackUnit places the previous contents of a unit file that failed to start
+// and runs the same action against it again
+func (sd *Systemd) rollbackUnit(ctx, conn context.Context, path, dest, action, prevUnit string) error {
+	service := filepath.Base(path)
+	klog.Warningf("Systemd target: %s, unit %s failed, rolling back to previous unit file", sd.Name, service)
+	rollbackPath := filepath.Join(systemdRollbackDir, sd.Name, service)
+	if err := os.MkdirAll(filepath.Join("/opt", filepath.Dir(rollbackPath)), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join("/opt", rollbackPath), []byte(prevUnit), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join("/opt", rollbackPath))
+	ft, err := sd.fileTransfer(conn, dest)
+	if err != nil {
+		return err
+	}
+	if err := ft.fileTransferPodman(ctx, conn, rollbackPath, dest, nil); err != nil {
+		return err
+	}
+	return sd.runUnitAction(conn, action, dest, service)
+}
+
+// runUnitAction runs action against a placed unit file, or against every
+// declared instance when the unit file is a template
+func (sd *Systemd) runUnitAction(conn context.Context, action, dest, service string) error {
+	if isTemplateUnit(service) {
+		return sd.applyInstances(conn, action, dest, service, true)
+	}
+	return sd.enableRestartSystemdService(conn, action, dest, service)
 }
 
 func (sd *Systemd) enableRestartSystemdService(conn context.Context, action, dest, service string) error {
@@ -222,11 +455,20 @@ func (sd *Systemd) enableRestartSystemdService(conn context.Context, action, des
 	runMountc := "/sys/fs/cgroup"
 	xdg := ""
 	if !sd.Root {
-		// need to document this for non-root usage
-		// can't use user.Current because always root in fetchit container
-		xdg = os.Getenv("XDG_RUNTIME_DIR")
-		if xdg == "" {
-			xdg = "/run/user/1000"
+		if sd.User != "" {
+			u, err := sd.resolveUser(conn)
+			if err != nil {
+				return err
+			}
+			xdg = u.RuntimeDir
+			s.User = u.userSpec()
+		} else {
+			// need to document this for non-root usage
+			// can't use user.Current because always root in fetchit container
+			xdg = os.Getenv("XDG_RUNTIME_DIR")
+			if xdg == "" {
+				xdg = "/run/user/1000"
+			}
 		}
 		runMountsd = xdg + "/systemd"
 		runMounttmp = xdg
@@ -241,12 +483,26 @@ func (sd *Systemd) enableRestartSystemdService(conn context.Context, action, des
 	} else {
 		s.Mounts = []specs.Mount{{Source: dest, Destination: dest, Type: define.TypeBind, Options: []string{"rw"}}, {Source: runMounttmp, Destination: runMounttmp, Type: define.TypeTmpfs, Options: []string{"rw"}}, {Source: runMountc, Destination: runMountc, Type: define.TypeBind, Options: []string{"ro"}}, {Source: runMountsd, Destination: runMountsd, Type: define.TypeBind, Options: []string{"rw"}}}
 	}
+	if sd.hostUser != nil {
+		bus := filepath.Join(xdg, "bus")
+		s.Mounts = append(s.Mounts, specs.Mount{Source: bus, Destination: bus, Type: define.TypeBind, Options: []string{"rw"}})
+	}
 	s.Name = "systemd-" + act + "-" + service + "-" + sd.Name
 	envMap := make(map[string]string)
 	envMap["ROOT"] = strconv.FormatBool(sd.Root)
 	envMap["SERVICE"] = service
 	envMap["ACTION"] = act
 	envMap["HOME"] = os.Getenv("HOME")
+	if sd.hostUser != nil {
+		envMap["HOME"] = sd.hostUser.Home
+		envMap["USER"] = sd.hostUser.Name
+		envMap["DBUS_SESSION_BUS_ADDRESS"] = sd.hostUser.busAddress()
+	}
+	journalLines := defaultJournalLines
+	if sd.JournalLines != nil {
+		journalLines = *sd.JournalLines
+	}
+	envMap["JOURNAL_LINES"] = strconv.Itoa(journalLines)
 	if !sd.Root {
 		envMap["XDG_RUNTIME_DIR"] = xdg
 	}
@@ -256,10 +512,304 @@ func (sd *Systemd) enableRestartSystemdService(conn context.Context, action, des
 		return err
 	}
 
-	err = waitAndRemoveContainer(conn, createResponse.ID)
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
 	if err != nil {
 		return err
 	}
+	if err := sd.recordUnitStatus(act, service, exitCode, output); err != nil {
+		return err
+	}
 	klog.Infof("Systemd target %s-%s %s complete", sd.Name, act, service)
 	return nil
 }
+
+// recordUnitStatus keeps the unit status reported by the systemd method container and
+// fails if the container exited non-zero or the unit did not reach a healthy state
+func (sd *Systemd) recordUnitStatus(act, service string, exitCode int32, output string) error {
+	status := parseUnitStatus(service, output)
+	if sd.unitStatus == nil {
+		sd.unitStatus = make(map[string]*UnitStatus)
+	}
+	sd.unitStatus[service] = status
+	klog.Infof("Systemd target: %s, %s", sd.Name, status)
+	if exitCode != 0 || status.Failed() {
+		for _, line := range status.Journal {
+			klog.Warningf("Systemd target: %s, %s journal: %s", sd.Name, service, line)
+		}
+		return fmt.Errorf("systemctl %s %s failed, %s", act, service, status)
+	}
+	return nil
+}
+
+// enableLinger runs loginctl enable-linger for User on the host so that
+// the user's service manager starts at boot and outlives their sessions
+func (sd *Systemd) enableLinger(conn context.Context) error {
+	klog.Infof("Systemd target: %s, enabling linger for user %s", sd.Name, sd.hostUser.Name)
+	if err := detectOrFetchImage(conn, systemdImage, false); err != nil {
+		return err
+	}
+	s := specgen.NewSpecGenerator(systemdImage, false)
+	s.Name = "systemd-linger-" + sd.hostUser.Name + "-" + sd.Name
+	s.Privileged = true
+	s.PidNS = specgen.Namespace{
+		NSMode: "host",
+		Value:  "",
+	}
+	s.Mounts = []specs.Mount{{Source: "/run", Destination: "/run", Type: define.TypeTmpfs, Options: []string{"rw"}}, {Source: "/run/dbus", Destination: "/run/dbus", Type: define.TypeBind, Options: []string{"rw"}}, {Source: "/run/systemd", Destination: "/run/systemd", Type: define.TypeBind, Options: []string{"rw"}}}
+	s.Env = map[string]string{
+		"ROOT":         "true",
+		"ACTION":       "linger",
+		"SYSTEMD_USER": sd.hostUser.Name,
+	}
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return err
+	}
+	exitCode, output, err := waitCollectAndRemoveContainer(conn, createResponse.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("loginctl enable-linger %s exited with %d: %s", sd.hostUser.Name, exitCode, strings.TrimSpace(output))
+	}
+	// logind now tracks the user, pick up the runtime directory it assigned
+	u, err := lookupHostUser(conn, sd.User)
+	if err != nil {
+		return err
+	}
+	sd.hostUser = u
+	return nil
+}
+
+// isTemplateUnit is true for template unit files such as worker@.service
+func isTemplateUnit(service string) bool {
+	return strings.Contains(service, "@.")
+}
+
+// instanceUnit returns the name of an instance of a template unit, worker@.service with 1 is worker@1.service
+func instanceUnit(template, instance string) string {
+	return strings.Replace(template, "@.", "@"+instance+".", 1)
+}
+
+// expandInstances removes comments and blank entries and expands numeric ranges such as 1..8
+func expandInstances(entries []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var instances []string
+	add := func(i string) {
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			instances = append(instances, i)
+		}
+	}
+	for _, entry := range entries {
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		bounds := strings.SplitN(entry, "..", 2)
+		if len(bounds) != 2 {
+			add(entry)
+			continue
+		}
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance range %s: %v", entry, err)
+		}
+		last, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance range %s: %v", entry, err)
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid instance range %s: end is before start", entry)
+		}
+		for i := first; i <= last; i++ {
+			add(strconv.Itoa(i))
+		}
+	}
+	return instances, nil
+}
+
+// desiredInstances combines Instances with the contents of InstancesFile at the checked out commit
+func (sd *Systemd) desiredInstances() ([]string, error) {
+	entries := append([]string{}, sd.Instances...)
+	if sd.InstancesFile != "" {
+		file := filepath.Join(getDirectory(sd.GetTarget()), sd.InstancesFile)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error reading instances file %s", file)
+		}
+		entries = append(entries, strings.Split(string(b), "\n")...)
+	}
+	return expandInstances(entries)
+}
+
+// skipInstancesFile removes InstancesFile from the changes to deploy, as it lists instances and
+// is not a unit file, even when it is under targetPath and matches the glob
+func (sd *Systemd) skipInstancesFile(changeMap map[*object.Change]string) {
+	if sd.InstancesFile == "" {
+		return
+	}
+	instancesFile := filepath.Clean(sd.InstancesFile)
+	for change := range changeMap {
+		for _, name := range []string{change.To.Name, change.From.Name} {
+			if name != "" && filepath.Join(sd.GetTargetPath(), name) == instancesFile {
+				delete(changeMap, change)
+				break
+			}
+		}
+	}
+}
+
+// instanceAction runs action against an instance of a template unit
+func (sd *Systemd) instanceAction(conn context.Context, action, dest, service string) error {
+	if sd.systemctl != nil {
+		return sd.systemctl(conn, action, dest, service)
+	}
+	return sd.enableRestartSystemdService(conn, action, dest, service)
+}
+
+func (sd *Systemd) instanceStatePath(template string) string {
+	return filepath.Join(systemdInstancesDir, sd.Name, template)
+}
+
+// enabledInstances returns the instances of template fetchit last enabled
+func (sd *Systemd) enabledInstances(template string) (map[string]struct{}, error) {
+	enabled := make(map[string]struct{})
+	b, err := os.ReadFile(sd.instanceStatePath(template))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return enabled, nil
+		}
+		return nil, err
+	}
+	for _, i := range strings.Split(string(b), "\n") {
+		if i != "" {
+			enabled[i] = struct{}{}
+		}
+	}
+	return enabled, nil
+}
+
+func (sd *Systemd) saveEnabledInstances(template string, enabled map[string]struct{}) error {
+	instances := make([]string, 0, len(enabled))
+	for i := range enabled {
+		instances = append(instances, i)
+	}
+	sort.Strings(instances)
+	statePath := sd.instanceStatePath(template)
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, []byte(strings.Join(instances, "\n")+"\n"), 0644)
+}
+
+// applyInstances stops and disables instances of template that are no longer declared and
+// enables new ones. If the template itself changed, action runs against every declared instance.
+func (sd *Systemd) applyInstances(conn context.Context, action, dest, template string, templateChanged bool) error {
+	desired, err := sd.desiredInstances()
+	if err != nil {
+		return err
+	}
+	enabled, err := sd.enabledInstances(template)
+	if err != nil {
+		return err
+	}
+	if len(desired) == 0 && len(enabled) == 0 {
+		klog.Warningf("Systemd target: %s, no instances declared for template %s", sd.Name, template)
+		return nil
+	}
+
+	var errs []string
+	want := make(map[string]struct{})
+	for _, i := range desired {
+		want[i] = struct{}{}
+	}
+	for i := range enabled {
+		if _, ok := want[i]; ok {
+			continue
+		}
+		if err := sd.instanceAction(conn, "disable", dest, instanceUnit(template, i)); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(enabled, i)
+	}
+	for _, i := range desired {
+		_, running := enabled[i]
+		if running && !templateChanged {
+			continue
+		}
+		act := action
+		if !running {
+			act = "enable"
+		}
+		if err := sd.instanceAction(conn, act, dest, instanceUnit(template, i)); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		enabled[i] = struct{}{}
+	}
+	if err := sd.saveEnabledInstances(template, enabled); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Systemd target %s template %s: %s", sd.Name, template, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// removeInstances stops and disables every instance of a template unit that was deleted and
+// forgets them. Instances that fail to stop are kept, so they are disabled on the next run.
+func (sd *Systemd) removeInstances(conn context.Context, dest, template string) error {
+	enabled, err := sd.enabledInstances(template)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for i := range enabled {
+		klog.Infof("Systemd target: %s, template %s was deleted, disabling %s", sd.Name, template, instanceUnit(template, i))
+		if err := sd.instanceAction(conn, "disable", dest, instanceUnit(template, i)); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(enabled, i)
+	}
+	if len(errs) > 0 {
+		if err := sd.saveEnabledInstances(template, enabled); err != nil {
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("Systemd target %s template %s: %s", sd.Name, template, strings.Join(errs, "; "))
+	}
+	if err := os.Remove(sd.instanceStatePath(template)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// reconcileInstances applies changes to the declared instance list of each
+// template unit placed by this method, even when no unit file changed
+func (sd *Systemd) reconcileInstances(conn context.Context) error {
+	if !sd.Enable || (len(sd.Instances) == 0 && sd.InstancesFile == "") {
+		return nil
+	}
+	templates, err := os.ReadDir(filepath.Join(systemdInstancesDir, sd.Name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	dest, err := sd.unitDir(conn)
+	if err != nil {
+		return err
+	}
+	for _, t := range templates {
+		if err := sd.applyInstances(conn, "enable", dest, t.Name(), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
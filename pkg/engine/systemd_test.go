@@ -0,0 +1,271 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// recordSystemctl makes sd record the actions run against instances, failing those in fail
+func recordSystemctl(sd *Systemd, fail ...string) *[]string {
+	var calls []string
+	sd.systemctl = func(conn context.Context, action, dest, service string) error {
+		calls = append(calls, action+" "+service)
+		for _, f := range fail {
+			if f == service {
+				return fmt.Errorf("%s failed", service)
+			}
+		}
+		return nil
+	}
+	return &calls
+}
+
+func testSystemd(t *testing.T, instances ...string) *Systemd {
+	dir := systemdInstancesDir
+	t.Cleanup(func() { systemdInstancesDir = dir })
+	systemdInstancesDir = t.TempDir()
+	return &Systemd{
+		CommonMethod: CommonMethod{Name: "workers"},
+		Root:         true,
+		Enable:       true,
+		Instances:    instances,
+	}
+}
+
+func enabledList(t *testing.T, sd *Systemd, template string) []string {
+	enabled, err := sd.enabledInstances(template)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	var list []string
+	for i := range enabled {
+		list = append(list, i)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestApplyInstances(t *testing.T) {
+	const template = "worker@.service"
+	tests := []struct {
+		name            string
+		instances       []string
+		enabled         map[string]struct{}
+		action          string
+		templateChanged bool
+		fail            []string
+		calls           []string
+		after           []string
+		err             bool
+	}{
+		{
+			name:            "add",
+			instances:       []string{"1..3"},
+			action:          "enable",
+			templateChanged: true,
+			calls:           []string{"enable worker@1.service", "enable worker@2.service", "enable worker@3.service"},
+			after:           []string{"1", "2", "3"},
+		},
+		{
+			name:      "remove",
+			instances: []string{"1"},
+			enabled:   map[string]struct{}{"1": {}, "2": {}},
+			action:    "enable",
+			calls:     []string{"disable worker@2.service"},
+			after:     []string{"1"},
+		},
+		{
+			name:            "template changed restarts every instance",
+			instances:       []string{"1", "2"},
+			enabled:         map[string]struct{}{"1": {}, "2": {}},
+			action:          "restart",
+			templateChanged: true,
+			calls:           []string{"restart worker@1.service", "restart worker@2.service"},
+			after:           []string{"1", "2"},
+		},
+		{
+			name:      "failures are retried",
+			instances: []string{"2"},
+			enabled:   map[string]struct{}{"1": {}},
+			action:    "enable",
+			fail:      []string{"worker@1.service", "worker@2.service"},
+			calls:     []string{"disable worker@1.service", "enable worker@2.service"},
+			after:     []string{"1"},
+			err:       true,
+		},
+	}
+	for _, tt := range tests {
+		sd := testSystemd(t, tt.instances...)
+		if tt.enabled != nil {
+			if err := sd.saveEnabledInstances(template, tt.enabled); err != nil {
+				t.Fatalf("Failed: %v", err)
+			}
+		}
+		calls := recordSystemctl(sd, tt.fail...)
+		err := sd.applyInstances(context.Background(), tt.action, systemdPathRoot, template, tt.templateChanged)
+		if (err != nil) != tt.err {
+			t.Errorf("Failed %s: unexpected error %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(*calls, tt.calls) {
+			t.Errorf("Failed %s: expected %v, got %v", tt.name, tt.calls, *calls)
+		}
+		if after := enabledList(t, sd, template); !reflect.DeepEqual(after, tt.after) {
+			t.Errorf("Failed %s: expected enabled %v, got %v", tt.name, tt.after, after)
+		}
+	}
+}
+
+func TestRemoveInstances(t *testing.T) {
+	const template = "worker@.service"
+	sd := testSystemd(t)
+	if err := sd.saveEnabledInstances(template, map[string]struct{}{"1": {}, "2": {}}); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	calls := recordSystemctl(sd, "worker@2.service")
+	if err := sd.removeInstances(context.Background(), systemdPathRoot, template); err == nil {
+		t.Fatalf("Failed: expected error when an instance fails to stop")
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("Failed: expected every instance to be disabled, got %v", *calls)
+	}
+	if after := enabledList(t, sd, template); !reflect.DeepEqual(after, []string{"2"}) {
+		t.Fatalf("Failed: instance that failed to stop should be kept, got %v", after)
+	}
+
+	calls = recordSystemctl(sd)
+	if err := sd.removeInstances(context.Background(), systemdPathRoot, template); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if !reflect.DeepEqual(*calls, []string{"disable worker@2.service"}) {
+		t.Fatalf("Failed: unexpected calls %v", *calls)
+	}
+	if _, err := os.Stat(sd.instanceStatePath(template)); !os.IsNotExist(err) {
+		t.Fatalf("Failed: state of a deleted template should be removed: %v", err)
+	}
+}
+
+func TestReconcileInstances(t *testing.T) {
+	sd := testSystemd(t, "2", "3")
+	for _, template := range []string{"worker@.service", "queue@.service"} {
+		if err := sd.saveEnabledInstances(template, map[string]struct{}{"1": {}, "2": {}}); err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+	}
+	calls := recordSystemctl(sd)
+	if err := sd.reconcileInstances(context.Background()); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	expected := []string{
+		"disable queue@1.service", "enable queue@3.service",
+		"disable worker@1.service", "enable worker@3.service",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("Failed: expected %v, got %v", expected, *calls)
+	}
+
+	// a deleted template has no state left to reconcile
+	if err := sd.removeInstances(context.Background(), systemdPathRoot, "queue@.service"); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	calls = recordSystemctl(sd)
+	if err := sd.reconcileInstances(context.Background()); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if len(*calls) != 0 {
+		t.Fatalf("Failed: nothing should change, got %v", *calls)
+	}
+}
+
+func TestSkipInstancesFile(t *testing.T) {
+	sd := &Systemd{CommonMethod: CommonMethod{TargetPath: "examples/systemd"}, InstancesFile: "examples/systemd/instances"}
+	unit := &object.Change{To: object.ChangeEntry{Name: "worker@.service"}}
+	added := &object.Change{To: object.ChangeEntry{Name: "instances"}}
+	deleted := &object.Change{From: object.ChangeEntry{Name: "instances"}}
+	changeMap := map[*object.Change]string{unit: "fetchit/examples/systemd/worker@.service", added: "fetchit/examples/systemd/instances", deleted: deleteFile}
+	sd.skipInstancesFile(changeMap)
+	if len(changeMap) != 1 || changeMap[unit] == "" {
+		t.Fatalf("Failed: expected only the unit file to be deployed, got %v", changeMap)
+	}
+}
+
+const testShowActive = `ActiveState=active
+SubState=running
+Result=success
+JOURNAL:
+Oct 18 10:00:01 node1 systemd[1]: Started httpd.service - The Apache HTTP Server.
+`
+
+const testShowFailed = `ActiveState=failed
+SubState=failed
+Result=exit-code
+JOURNAL:
+Oct 18 10:00:01 node1 httpd[412]: AH00526: Syntax error on line 12 of /etc/httpd/conf/httpd.conf
+Oct 18 10:00:01 node1 systemd[1]: httpd.service: Main process exited, code=exited, status=1/FAILURE
+Oct 18 10:00:01 node1 systemd[1]: httpd.service: Failed with result 'exit-code'.
+`
+
+const testShowActivating = `ActiveState=activating
+SubState=auto-restart
+Result=success
+JOURNAL:
+-- No entries --
+`
+
+func TestRecordUnitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int32
+		status   UnitStatus
+		failed   bool
+		err      bool
+	}{
+		{
+			name:   "active",
+			output: testShowActive,
+			status: UnitStatus{Unit: "httpd.service", ActiveState: "active", SubState: "running", Result: "success", Journal: []string{"Oct 18 10:00:01 node1 systemd[1]: Started httpd.service - The Apache HTTP Server."}},
+		},
+		{
+			name:     "failed",
+			output:   testShowFailed,
+			exitCode: 1,
+			status: UnitStatus{Unit: "httpd.service", ActiveState: "failed", SubState: "failed", Result: "exit-code", Journal: []string{
+				"Oct 18 10:00:01 node1 httpd[412]: AH00526: Syntax error on line 12 of /etc/httpd/conf/httpd.conf",
+				"Oct 18 10:00:01 node1 systemd[1]: httpd.service: Main process exited, code=exited, status=1/FAILURE",
+				"Oct 18 10:00:01 node1 systemd[1]: httpd.service: Failed with result 'exit-code'.",
+			}},
+			failed: true,
+			err:    true,
+		},
+		{
+			name:     "non-zero exit of a unit that is not failed",
+			output:   testShowActivating,
+			exitCode: 1,
+			status:   UnitStatus{Unit: "httpd.service", ActiveState: "activating", SubState: "auto-restart", Result: "success", Journal: []string{"-- No entries --"}},
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		sd := &Systemd{CommonMethod: CommonMethod{Name: "test"}}
+		err := sd.recordUnitStatus("enable", "httpd.service", tt.exitCode, tt.output)
+		if (err != nil) != tt.err {
+			t.Errorf("Failed %s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+		status := sd.unitStatus["httpd.service"]
+		if status == nil {
+			t.Fatalf("Failed %s: status was not recorded", tt.name)
+		}
+		if !reflect.DeepEqual(*status, tt.status) {
+			t.Errorf("Failed %s: expected %+v, got %+v", tt.name, tt.status, *status)
+		}
+		if status.Failed() != tt.failed {
+			t.Errorf("Failed %s: expected Failed() %v, got %v", tt.name, tt.failed, status.Failed())
+		}
+	}
+}
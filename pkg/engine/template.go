@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/system"
+)
+
+const (
+	fibMarker   = "FIB:"
+	inet6Marker = "INET6:"
+)
+
+// HostFacts describe the host fetchit manages, available to templates as .Host
+type HostFacts struct {
+	Hostname  string
+	Arch      string
+	OS        string
+	Kernel    string
+	IPs       []string
+	OSRelease map[string]string
+}
+
+// TemplateData is passed to templates rendered by fetchit
+type TemplateData struct {
+	// Host holds facts gathered from the host
+	Host *HostFacts
+	// Vars holds variables declared on the target, overridden by those declared on the method
+	Vars map[string]interface{}
+	// Env holds the environment of the fetchit container
+	Env map[string]string
+	// Secrets holds the contents of secret files keyed by file name
+	Secrets map[string]string
+}
+
+// gatherHostFacts asks podman for the host's name, architecture and kernel and
+// reads its os-release and addresses through the host pid namespace
+func gatherHostFacts(conn context.Context) (*HostFacts, error) {
+	info, err := system.Info(conn, nil)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error getting host info from podman")
+	}
+	facts := &HostFacts{
+		OSRelease: make(map[string]string),
+	}
+	if info.Host != nil {
+		facts.Hostname = info.Host.Hostname
+		facts.Arch = info.Host.Arch
+		facts.OS = info.Host.OS
+		facts.Kernel = info.Host.Kernel
+	}
+	osRelease := filepath.Join(hostRoot, "etc", "os-release")
+	output, err := runHostCommand(conn, "host-facts", "cat "+osRelease+"; echo "+fibMarker+"; cat /proc/1/net/fib_trie; echo "+inet6Marker+"; cat /proc/1/net/if_inet6")
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading host facts")
+	}
+	parseHostFacts(facts, output)
+	return facts, nil
+}
+
+// parseHostFacts reads os-release, followed by the IPv4 fib trie and IPv6 address
+// table of the host network namespace, collecting non-loopback addresses
+func parseHostFacts(facts *HostFacts, output string) {
+	section := ""
+	lastIP := ""
+	seen := make(map[string]struct{})
+	addIP := func(ip net.IP) {
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			return
+		}
+		if _, ok := seen[ip.String()]; !ok {
+			seen[ip.String()] = struct{}{}
+			facts.IPs = append(facts.IPs, ip.String())
+		}
+	}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == fibMarker || line == inet6Marker {
+			section = line
+			continue
+		}
+		switch section {
+		case "":
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) == 2 {
+				facts.OSRelease[kv[0]] = strings.Trim(kv[1], `"'`)
+			}
+		case fibMarker:
+			// local addresses appear as "|-- <ip>" followed by "/32 host LOCAL"
+			if strings.HasPrefix(line, "|-- ") {
+				lastIP = strings.TrimPrefix(line, "|-- ")
+			} else if strings.HasPrefix(line, "/32 host LOCAL") {
+				addIP(net.ParseIP(lastIP))
+			}
+		case inet6Marker:
+			// <address in hex> <ifindex> <prefix length> <scope> <flags> <name>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[3] != "00" {
+				continue
+			}
+			b, err := hex.DecodeString(fields[0])
+			if err != nil || len(b) != net.IPv6len {
+				continue
+			}
+			addIP(net.IP(b))
+		}
+	}
+}
+
+// gatherTemplateData collects the data available to a FileTransfer's templates
+func (ft *FileTransfer) gatherTemplateData(conn context.Context) (*TemplateData, error) {
+	facts, err := gatherHostFacts(conn)
+	if err != nil {
+		return nil, err
+	}
+	data := &TemplateData{
+		Host:    facts,
+		Vars:    make(map[string]interface{}),
+		Env:     make(map[string]string),
+		Secrets: make(map[string]string),
+	}
+	if target := ft.GetTarget(); target != nil {
+		for k, v := range target.vars {
+			data.Vars[k] = v
+		}
+	}
+	for k, v := range ft.Vars {
+		data.Vars[k] = v
+	}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			data.Env[kv[0]] = kv[1]
+		}
+	}
+	for _, f := range ft.SecretFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error reading secret file %s", f)
+		}
+		data.Secrets[filepath.Base(f)] = strings.TrimRight(string(b), "\n")
+	}
+	return data, nil
+}
+
+// renderTemplate executes the template in path with data, failing on missing map keys
+func renderTemplate(path string, data *TemplateData) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error parsing template %s", path)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, utils.WrapErr(err, "Error rendering template %s", path)
+	}
+	return out.Bytes(), nil
+}
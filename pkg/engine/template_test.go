@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFibTrie = `Main:
+  +-- 0.0.0.0/0 3 0 5
+     |-- 0.0.0.0
+        /0 universe UNICAST
+     +-- 127.0.0.0/8 2 0 2
+        |-- 127.0.0.1
+           /32 host LOCAL
+     |-- 192.168.1.0
+        /24 link UNICAST
+     |-- 192.168.1.10
+        /32 host LOCAL
+Local:
+     |-- 127.0.0.1
+        /32 host LOCAL
+     |-- 192.168.1.10
+        /32 host LOCAL
+`
+
+const testInet6 = `00000000000000000000000000000001 01 80 10 80       lo
+fe800000000000000000000000000001 02 40 20 80     eth0
+20010db8000000000000000000000001 02 40 00 00     eth0
+`
+
+func TestParseHostFacts(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		osRelease map[string]string
+		ips       []string
+	}{
+		{
+			name:      "os-release only",
+			output:    "ID=fedora\nVERSION_ID=\"36\"\nPRETTY_NAME='Fedora Linux 36'\n\n",
+			osRelease: map[string]string{"ID": "fedora", "VERSION_ID": "36", "PRETTY_NAME": "Fedora Linux 36"},
+		},
+		{
+			name:      "addresses without loopback, link-local and duplicates",
+			output:    "ID=rhel\n" + fibMarker + "\n" + testFibTrie + inet6Marker + "\n" + testInet6,
+			osRelease: map[string]string{"ID": "rhel"},
+			ips:       []string{"192.168.1.10", "2001:db8::1"},
+		},
+		{
+			name:      "malformed lines",
+			output:    "garbage\n" + fibMarker + "\n|-- not-an-ip\n/32 host LOCAL\n" + inet6Marker + "\nzz 02 40 00 00 eth0\n0102 02 40 00 00 eth0\nshort\n",
+			osRelease: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		facts := &HostFacts{OSRelease: make(map[string]string)}
+		parseHostFacts(facts, tt.output)
+		if !reflect.DeepEqual(facts.OSRelease, tt.osRelease) {
+			t.Errorf("Failed %s: expected os-release %v, got %v", tt.name, tt.osRelease, facts.OSRelease)
+		}
+		if !reflect.DeepEqual(facts.IPs, tt.ips) {
+			t.Errorf("Failed %s: expected addresses %v, got %v", tt.name, tt.ips, facts.IPs)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	data := &TemplateData{
+		Host:    &HostFacts{Hostname: "node1", IPs: []string{"192.168.1.10"}, OSRelease: map[string]string{"ID": "fedora"}},
+		Vars:    map[string]interface{}{"port": 8080},
+		Env:     map[string]string{"REGION": "eu"},
+		Secrets: map[string]string{"token": "s3cret"},
+	}
+	tests := []struct {
+		name     string
+		template string
+		out      string
+		err      string
+	}{
+		{
+			name:     "host facts, vars, env and secrets",
+			template: "{{.Host.Hostname}} {{index .Host.IPs 0}} {{.Host.OSRelease.ID}} {{.Vars.port}} {{.Env.REGION}} {{.Secrets.token}}",
+			out:      "node1 192.168.1.10 fedora 8080 eu s3cret",
+		},
+		{
+			name:     "missing key",
+			template: "{{.Vars.missing}}",
+			err:      "Error rendering template",
+		},
+		{
+			name:     "invalid template",
+			template: "{{.Vars.port",
+			err:      "Error parsing template",
+		},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "template")
+		if err := os.WriteFile(path, []byte(tt.template), 0600); err != nil {
+			t.Fatalf("Failed: %v", err)
+		}
+		out, err := renderTemplate(path, data)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Failed %s: expected %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed %s: %v", tt.name, err)
+		}
+		if string(out) != tt.out {
+			t.Errorf("Failed %s: expected %q, got %q", tt.name, tt.out, out)
+		}
+	}
+}
@@ -25,9 +25,14 @@ type FetchitConfig struct {
 	Prune            *Prune            `mapstructure:"prune"`
 	PodmanAutoUpdate *PodmanAutoUpdate `mapstructure:"podmanAutoUpdate"`
 	Images           []*Image          `mapstructure:"images"`
+	ConfigSources    []*ConfigSource   `mapstructure:"configSources"`
 	PAT              string            `mapstructure:"pat"`
 	conn             context.Context
 	scheduler        *gocron.Scheduler
+	// configHash is the checksum of the effective config, merged from every source
+	configHash string
+	// hasSources is set when the config is merged from more than one file
+	hasSources bool
 }
 
 type TargetConfig struct {
@@ -41,7 +46,13 @@ type TargetConfig struct {
 	Kube         []*Kube         `mapstructure:"kube"`
 	Raw          []*Raw          `mapstructure:"raw"`
 	Systemd      []*Systemd      `mapstructure:"systemd"`
+	// Bundle verifies and limits the archive of a disconnected target
+	Bundle *Bundle `mapstructure:"bundle"`
+	// Vars are available to templates rendered by the target's methods
+	Vars map[string]interface{} `mapstructure:"vars"`
 
+	// source is the config the target was read from
+	source       string
 	image        *Image
 	prune        *Prune
 	configReload *ConfigReload
@@ -49,12 +60,19 @@ type TargetConfig struct {
 }
 
 type Target struct {
+	// name is the directory of a target without a url
+	name         string
 	url          string
 	device       string
 	localPath    string
 	branch       string
 	mu           sync.Mutex
 	disconnected bool
+	bundle       *Bundle
+	vars         map[string]interface{}
+	// username and password replace the PAT for targets with their own credentials
+	username string
+	password string
 }
 
 type SchedInfo struct {
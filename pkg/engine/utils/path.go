@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SafeJoin joins name onto base and returns an error if the result would
+// fall outside of base, e.g. a name of ../../etc/passwd or an absolute path
+func SafeJoin(base, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("path %s must be relative to %s", name, base)
+	}
+	base = filepath.Clean(base)
+	joined := filepath.Join(base, name)
+	if !IsWithin(base, joined) {
+		return "", fmt.Errorf("path %s escapes %s", name, base)
+	}
+	return joined, nil
+}
+
+// IsWithin is true if path is base or is below base
+func IsWithin(base, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(base), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ResolveWithin resolves a relative symlink target from dir the way the kernel would, following
+// the symlinks already present below root, and returns an error if the target leaves root. A ..
+// after a component that does not exist yet is rejected, as that component could still be
+// created as a symlink.
+func ResolveWithin(root, dir, target string) (string, error) {
+	if filepath.IsAbs(target) {
+		return "", fmt.Errorf("target %s must be relative", target)
+	}
+	root = filepath.Clean(root)
+	current := filepath.Clean(dir)
+	if !IsWithin(root, current) {
+		return "", fmt.Errorf("%s is not below %s", dir, root)
+	}
+	parts := strings.Split(target, "/")
+	links, missing := 0, false
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return "", fmt.Errorf("target %s goes up through %s, which does not exist", target, current)
+			}
+			if current == root {
+				return "", fmt.Errorf("target %s escapes %s", target, root)
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, part)
+		if missing {
+			current = next
+			continue
+		}
+		fi, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			missing = true
+			current = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		// 40 is the limit the kernel puts on links followed in a lookup
+		if links++; links > 40 {
+			return "", fmt.Errorf("target %s has too many levels of symlinks", target)
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			return "", fmt.Errorf("target %s goes through absolute symlink %s -> %s", target, next, link)
+		}
+		parts = append(strings.Split(link, "/"), parts...)
+	}
+	return current, nil
+}
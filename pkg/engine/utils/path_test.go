@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	valid := map[string]string{
+		"file.conf":           "/etc/app/file.conf",
+		"conf.d/site.conf":    "/etc/app/conf.d/site.conf",
+		"conf.d/../file.conf": "/etc/app/file.conf",
+		"..file":              "/etc/app/..file",
+		".":                   "/etc/app",
+	}
+	for name, expected := range valid {
+		joined, err := SafeJoin("/etc/app/", name)
+		if err != nil {
+			t.Fatalf("Failed: %s: %v", name, err)
+		}
+		if joined != expected {
+			t.Fatalf("Failed: %s joined to %s != %s", name, joined, expected)
+		}
+	}
+
+	for _, name := range []string{"..", "../app2/file", "conf.d/../../passwd", "/etc/passwd"} {
+		if joined, err := SafeJoin("/etc/app", name); err == nil {
+			t.Fatalf("Failed: %s should not be joined, got %s", name, joined)
+		}
+	}
+}
+
+func TestResolveWithin(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "x", "y"), 0755); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if err := os.Symlink("../..", filepath.Join(root, "x", "y", "l1")); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	dir := filepath.Join(root, "x", "y")
+
+	valid := map[string]string{
+		"l1":          root,
+		"l1/x":        filepath.Join(root, "x"),
+		"../y/./file": filepath.Join(dir, "file"),
+		"new/file":    filepath.Join(dir, "new", "file"),
+	}
+	for target, expected := range valid {
+		resolved, err := ResolveWithin(root, dir, target)
+		if err != nil {
+			t.Fatalf("Failed: %s: %v", target, err)
+		}
+		if resolved != expected {
+			t.Fatalf("Failed: %s resolved to %s != %s", target, resolved, expected)
+		}
+	}
+
+	// l1/../../.. looks like x when read as text, but l1 is the root
+	for _, target := range []string{"l1/../../..", "l1/..", "../../..", "/etc", "new/../../../.."} {
+		if resolved, err := ResolveWithin(root, dir, target); err == nil {
+			t.Fatalf("Failed: %s should not resolve, got %s", target, resolved)
+		}
+	}
+	if _, err := ResolveWithin(root, dir, "missing/../file"); err == nil {
+		t.Fatalf("Failed: expected error for .. after a missing component")
+	}
+}
@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"net/url"
+)
+
+// StripUserinfo removes the user name and password from a url so it can be printed. Anything
+// that does not parse as a url, such as git@host:repo, is returned as it is.
+func StripUserinfo(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
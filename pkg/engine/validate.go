@@ -0,0 +1,355 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// configError is a problem with the config, at a line of the source it was read from
+type configError struct {
+	source string
+	line   int
+	msg    string
+}
+
+func (e configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.source, e.line, e.msg)
+	}
+	return fmt.Sprintf("%s: %s", e.source, e.msg)
+}
+
+// configErrors is every problem found validating a config, one per line
+type configErrors []configError
+
+func (e configErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *configErrors) add(source string, node *yaml.Node, format string, args ...interface{}) {
+	line := 0
+	if node != nil {
+		line = node.Line
+	}
+	*e = append(*e, configError{source: source, line: line, msg: fmt.Sprintf(format, args...)})
+}
+
+// validate decodes the effective config, rejecting unknown fields, values of the wrong type and
+// settings that would otherwise only fail once the methods are scheduled
+func (m *mergedConfig) validate() (*FetchitConfig, error) {
+	var errs configErrors
+	for _, doc := range m.docs {
+		if doc.node != nil {
+			checkFields(doc.node, reflect.TypeOf(FetchitConfig{}), "", doc.source, &errs)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	config, err := m.decode()
+	if err != nil {
+		return nil, err
+	}
+	m.checkConfig(config, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// checkFields checks node against the type it decodes into, matching keys to mapstructure tags the
+// way the config is decoded
+func checkFields(n *yaml.Node, t reflect.Type, path, source string, errs *configErrors) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	if n.Tag == "!!null" {
+		return
+	}
+	name := path
+	if name == "" {
+		name = "config"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			errs.add(source, n, "%s: must be a map", name)
+			return
+		}
+		fields := configFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Tag == "!!merge" {
+				continue
+			}
+			field, ok := fields[strings.ToLower(key.Value)]
+			if !ok {
+				errs.add(source, key, "%s: unknown field", fieldPath(path, key.Value))
+				continue
+			}
+			checkFields(value, field, fieldPath(path, key.Value), source, errs)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			errs.add(source, n, "%s: must be a map", name)
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			checkFields(n.Content[i+1], t.Elem(), fieldPath(path, n.Content[i].Value), source, errs)
+		}
+	case reflect.Slice:
+		// a single string is read as a comma separated list
+		if n.Kind == yaml.ScalarNode && t.Elem().Kind() == reflect.String {
+			return
+		}
+		if n.Kind != yaml.SequenceNode {
+			errs.add(source, n, "%s: must be a list", name)
+			return
+		}
+		for i, item := range n.Content {
+			checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), source, errs)
+		}
+	case reflect.Interface:
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n.Kind == yaml.ScalarNode && isConfigRef(n.Value) {
+			// checked once resolved, when the config is decoded
+			return
+		}
+		checkScalar(n, t.Kind(), name, source, errs)
+	default:
+		if n.Kind != yaml.ScalarNode {
+			errs.add(source, n, "%s: must be a single value", name)
+		}
+	}
+}
+
+func checkScalar(n *yaml.Node, kind reflect.Kind, name, source string, errs *configErrors) {
+	switch kind {
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(n.Value); n.Kind != yaml.ScalarNode || err != nil {
+			errs.add(source, n, "%s: must be true or false", name)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(n.Value, 0, 64); n.Kind != yaml.ScalarNode || err != nil {
+			errs.add(source, n, "%s: must be a whole number", name)
+		}
+	}
+}
+
+// configFields are the fields of a config struct by lowercased key, with squashed structs inlined
+func configFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.SplitN(f.Tag.Get("mapstructure"), ",", 2)
+		if len(tag) == 2 && tag[1] == "squash" {
+			for k, v := range configFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
+
+func fieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// nodeAt follows keys and list indexes from n, returning the deepest node found so errors point at
+// the closest line when a value is missing
+func nodeAt(n *yaml.Node, path ...interface{}) *yaml.Node {
+	for _, p := range path {
+		if n == nil {
+			return nil
+		}
+		if n.Kind == yaml.AliasNode && n.Alias != nil {
+			n = n.Alias
+		}
+		switch p := p.(type) {
+		case string:
+			if n.Kind != yaml.MappingNode {
+				return n
+			}
+			var next *yaml.Node
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if strings.EqualFold(n.Content[i].Value, p) {
+					next = n.Content[i+1]
+					break
+				}
+			}
+			if next == nil {
+				return n
+			}
+			n = next
+		case int:
+			if n.Kind != yaml.SequenceNode || p >= len(n.Content) {
+				return n
+			}
+			n = n.Content[p]
+		}
+	}
+	return n
+}
+
+// methodGroup is the methods of one kind in a target, and the key they are listed under
+type methodGroup struct {
+	kind    string
+	key     string
+	methods []*CommonMethod
+}
+
+func targetMethods(tc *TargetConfig) []methodGroup {
+	var ansible, filetransfer, kube, raw, systemd []*CommonMethod
+	for _, m := range tc.Ansible {
+		ansible = append(ansible, &m.CommonMethod)
+	}
+	for _, m := range tc.FileTransfer {
+		filetransfer = append(filetransfer, &m.CommonMethod)
+	}
+	for _, m := range tc.Kube {
+		kube = append(kube, &m.CommonMethod)
+	}
+	for _, m := range tc.Raw {
+		raw = append(raw, &m.CommonMethod)
+	}
+	for _, m := range tc.Systemd {
+		systemd = append(systemd, &m.CommonMethod)
+	}
+	return []methodGroup{
+		{kind: ansibleMethod, key: "ansible", methods: ansible},
+		{kind: filetransferMethod, key: "filetransfer", methods: filetransfer},
+		{kind: kubeMethod, key: "kube", methods: kube},
+		{kind: rawMethod, key: "raw", methods: raw},
+		{kind: systemdMethod, key: "systemd", methods: systemd},
+	}
+}
+
+// checkConfig checks the decoded config for what its types cannot express: required fields, cron
+// schedules, globs, and method names that would share a current-<kind>-<name> tag in one repository
+func (m *mergedConfig) checkConfig(config *FetchitConfig, errs *configErrors) {
+	tags := make(map[string]string)
+	for i, tc := range config.TargetConfigs {
+		var source string
+		var node *yaml.Node
+		if i < len(m.targetSources) {
+			source, node = m.targetSources[i], m.targetNodes[i]
+		}
+		label := tc.Name
+		if label == "" {
+			label = tc.Url + tc.Device
+		}
+		if tc.Url == "" && tc.Device == "" {
+			errs.add(source, node, "target %s: url or device is required", label)
+		}
+		if tc.Url != "" && tc.Device != "" {
+			errs.add(source, nodeAt(node, "device"), "target %s: only one of url or device may be set", label)
+		}
+		if tc.Branch == "" {
+			errs.add(source, node, "target %s: branch is required", label)
+		}
+		directory := getDirectory(&Target{name: tc.Name, url: tc.Url})
+		for _, group := range targetMethods(tc) {
+			for j, cm := range group.methods {
+				n := nodeAt(node, group.key, j)
+				where := fmt.Sprintf("target %s: %s[%d]", label, group.key, j)
+				if cm.Name != "" {
+					where = fmt.Sprintf("target %s: %s %s", label, group.key, cm.Name)
+				}
+				checkMethod(cm, true, true, where, source, n, errs)
+				if group.kind == filetransferMethod {
+					for k, h := range tc.FileTransfer[j].OnChange {
+						if h == nil {
+							h = &Hook{}
+						}
+						for _, problem := range h.validate() {
+							errs.add(source, nodeAt(n, "onChange", k), "%s: onChange[%d]: %s", where, k, problem)
+						}
+					}
+				}
+				if cm.Name == "" {
+					continue
+				}
+				tag := fmt.Sprintf("current-%s-%s", group.kind, cm.Name)
+				at := fmt.Sprintf("%s:%d", source, nodeAt(n, "name").Line)
+				if prev, ok := tags[directory+"/"+tag]; ok {
+					errs.add(source, nodeAt(n, "name"), "%s: name %s is already used at %s, both would track tag %s in repository %s", where, cm.Name, prev, tag, directory)
+					continue
+				}
+				tags[directory+"/"+tag] = at
+			}
+		}
+	}
+
+	if config.ConfigReload != nil {
+		source, n := m.keySources["configreload"], m.keyNodes["configreload"]
+		checkMethod(&config.ConfigReload.CommonMethod, false, false, "configReload", source, n, errs)
+		if config.ConfigReload.Git != nil && config.ConfigReload.Git.Url == "" {
+			errs.add(source, nodeAt(n, "git"), "configReload: git url is required")
+		}
+	}
+	if config.Prune != nil {
+		source := m.keySources["prune"]
+		checkMethod(&config.Prune.CommonMethod, false, false, "prune", source, m.keyNodes["prune"], errs)
+	}
+	for i, image := range config.Images {
+		var source string
+		var node *yaml.Node
+		if i < len(m.imageSources) {
+			source, node = m.imageSources[i], m.imageNodes[i]
+		}
+		where := fmt.Sprintf("images[%d]", i)
+		checkMethod(&image.CommonMethod, true, false, where, source, node, errs)
+		if image.Url == "" && image.ImagePath == "" && len(image.References) == 0 {
+			errs.add(source, node, "%s: one of url, imagePath or references is required", where)
+		}
+	}
+}
+
+// checkMethod checks the settings every method shares. configReload and prune are named by fetchit,
+// and methods reading a repository need a targetPath.
+func checkMethod(cm *CommonMethod, named, repo bool, where, source string, n *yaml.Node, errs *configErrors) {
+	if named && cm.Name == "" {
+		errs.add(source, n, "%s: name is required", where)
+	}
+	if cm.Schedule == "" {
+		errs.add(source, n, "%s: schedule is required", where)
+	} else if _, err := cron.ParseStandard(cm.Schedule); err != nil {
+		errs.add(source, nodeAt(n, "schedule"), "%s: invalid schedule %q: %v", where, cm.Schedule, err)
+	}
+	if cm.Skew != nil && *cm.Skew <= 0 {
+		errs.add(source, nodeAt(n, "skew"), "%s: skew must be greater than 0", where)
+	}
+	if !repo {
+		return
+	}
+	if cm.TargetPath == "" {
+		errs.add(source, n, "%s: targetPath is required", where)
+	}
+	if _, err := compileGlob(cm.Glob); err != nil {
+		errs.add(source, nodeAt(n, "glob"), "%s: %v", where, err)
+	}
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateExamples(t *testing.T) {
+	files, err := filepath.Glob("../../examples/*.yaml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Failed: no examples found: %v", err)
+	}
+	for _, f := range files {
+		merged, err := loadConfig(f)
+		if err != nil {
+			t.Fatalf("Failed: %s: %v", f, err)
+		}
+		if _, err := merged.validate(); err != nil {
+			t.Errorf("Failed: %s: %v", f, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{
+			name: "unknown and mistyped fields",
+			config: `
+targetConfigs:
+- url: https://github.com/containers/fetchit
+  branch: main
+  raw:
+  - name: web
+    targetPath: examples/raw
+    shedule: "*/1 * * * *"
+    pullImage: maybe
+`,
+			errs: []string{
+				"test:8: targetConfigs[0].raw[0].shedule: unknown field",
+				"test:9: targetConfigs[0].raw[0].pullImage: must be true or false",
+			},
+		},
+		{
+			name: "semantic checks",
+			config: `
+prune:
+  schedule: "0 0 * *"
+targetConfigs:
+- url: https://github.com/containers/fetchit
+  raw:
+  - name: web
+    targetPath: examples/raw
+    schedule: "*/1 * * * *"
+  - name: web
+    schedule: "*/1 * * * *"
+    glob: "[a"
+`,
+			errs: []string{
+				"test:5: target https://github.com/containers/fetchit: branch is required",
+				"test:10: target https://github.com/containers/fetchit: raw web: targetPath is required",
+				"test:12: target https://github.com/containers/fetchit: raw web: Error compiling glob",
+				"test:10: target https://github.com/containers/fetchit: raw web: name web is already used at test:7",
+				"test:3: prune: invalid schedule",
+			},
+		},
+		{
+			name: "hooks",
+			config: `
+targetConfigs:
+- url: https://github.com/containers/fetchit
+  branch: main
+  filetransfer:
+  - name: nginx
+    targetPath: examples/nginx
+    destinationDirectory: /etc/nginx
+    schedule: "*/1 * * * *"
+    onChange:
+    - unit: nginx.service
+      container: nginx
+      action: reload
+    - label: app=web
+      action: signal
+      signal: SIGNOPE
+`,
+			errs: []string{
+				"test:11: target https://github.com/containers/fetchit: filetransfer nginx: onChange[0]: must set exactly one of unit, container or label",
+				"test:14: target https://github.com/containers/fetchit: filetransfer nginx: onChange[1]: invalid signal",
+			},
+		},
+	}
+	for _, tt := range tests {
+		merged, err := mergeConfigDocuments([]configDocument{parseTestConfig(t, "test", tt.config)})
+		if err != nil {
+			t.Fatalf("Failed %s: %v", tt.name, err)
+		}
+		_, err = merged.validate()
+		errs, ok := err.(configErrors)
+		if !ok || len(errs) != len(tt.errs) {
+			t.Fatalf("Failed %s: expected %d errors, got %v", tt.name, len(tt.errs), err)
+		}
+		for i, want := range tt.errs {
+			if !strings.HasPrefix(errs[i].Error(), want) {
+				t.Errorf("Failed %s: expected %q, got %q", tt.name, want, errs[i].Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/go-git/go-git/v5"
+	"github.com/spf13/cobra"
+)
+
+// validateOptions are the flags of fetchit validate
+type validateOptions struct {
+	config string
+	repos  []string
+}
+
+var validateOpts = &validateOptions{}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check a fetchit config, and the files its methods deploy",
+	Long: `Check a fetchit config, merged with its conf.d directory and configSources, the way fetchit start
+reads it, and print every problem found with the file and line it is on. With --repo, the raw, kube and
+systemd files each method would deploy from the head of a checkout of the target's repository are
+checked too.`,
+	Example: `  fetchit validate --config config.yaml
+  fetchit validate --config config.yaml --repo fetchit=.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cobra.CheckErr(validateOpts.run(os.Stdout))
+	},
+}
+
+func init() {
+	flags := validateCmd.Flags()
+	flags.StringVarP(&validateOpts.config, "config", "c", defaultConfigPath, "fetchit config file")
+	flags.StringArrayVar(&validateOpts.repos, "repo", nil, "checkout of a target's repository as name=dir, where name is the target's name or repository directory, or dir alone for every target")
+	fetchitCmd.AddCommand(validateCmd)
+}
+
+func (o *validateOptions) run(w io.Writer) error {
+	if _, err := os.Stat(o.config); err != nil {
+		return err
+	}
+	merged, err := loadConfig(o.config)
+	if err != nil {
+		return err
+	}
+	if err := merged.resolveRefs(); err != nil {
+		return err
+	}
+	config, err := merged.validate()
+	if err != nil {
+		return err
+	}
+	var named []string
+	var all string
+	for _, r := range o.repos {
+		if strings.Contains(r, "=") {
+			named = append(named, r)
+		} else {
+			all = r
+		}
+	}
+	repos, err := parseSources(named)
+	if err != nil {
+		return err
+	}
+
+	var errs configErrors
+	for _, tc := range config.TargetConfigs {
+		dir, ok := repos[tc.Name]
+		if !ok {
+			dir, ok = repos[getDirectory(&Target{name: tc.Name, url: tc.Url})]
+		}
+		if !ok {
+			dir, ok = all, all != ""
+		}
+		if ok {
+			checkRepository(dir, tc, &errs)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	fmt.Fprintf(w, "%s is valid\n", o.config)
+	return nil
+}
+
+// checkRepository checks the files the raw, kube and systemd methods of tc would deploy from the head
+// of the checkout at dir
+func checkRepository(dir string, tc *TargetConfig, errs *configErrors) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		errs.add(dir, nil, "%v", err)
+		return
+	}
+	head, err := repo.Head()
+	if err != nil {
+		errs.add(dir, nil, "%v", err)
+		return
+	}
+	check := func(kind string, cm *CommonMethod, tags []string, checkFile func([]byte) error) {
+		paths, err := methodFiles(dir, head.Hash(), cm.TargetPath, cm.Glob, tags)
+		if err != nil {
+			errs.add(dir, nil, "%s %s: %v", kind, cm.Name, err)
+			return
+		}
+		for _, p := range paths {
+			b, err := ioutil.ReadFile(p)
+			if err == nil {
+				err = checkFile(b)
+			}
+			if err != nil {
+				errs.add(p, nil, "%s %s: %v", kind, cm.Name, err)
+			}
+		}
+	}
+	for _, r := range tc.Raw {
+		check(rawMethod, &r.CommonMethod, rawFileTags, checkRawFile)
+	}
+	for _, k := range tc.Kube {
+		check(kubeMethod, &k.CommonMethod, kubeFileTags, checkKubeFile)
+	}
+	for _, sd := range tc.Systemd {
+		check(systemdMethod, &sd.CommonMethod, systemdFileTags, checkSystemdFile)
+	}
+}
+
+func checkRawFile(b []byte) error {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	raw, err := rawPodFromBytes(b)
+	if err != nil {
+		return err
+	}
+	if raw.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if raw.Image == "" {
+		return fmt.Errorf("Image is required")
+	}
+	return nil
+}
+
+func checkKubeFile(b []byte) error {
+	pods, err := podFromBytes(b)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if err := validatePod(pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkSystemdFile(b []byte) error {
+	opts, err := unit.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if len(opts) == 0 {
+		return fmt.Errorf("unit file has no settings")
+	}
+	return nil
+}